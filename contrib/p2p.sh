@@ -0,0 +1,45 @@
+#!/bin/bash
+
+# runs a swarm of hochwasser peers against a fake (iperf) pixelflut server.
+# after the swarm converged, one peer is killed, and the remaining peers
+# rebalance their parts of the image. prints the final state of each peer.
+
+numPeers=${1:-4}
+runtime=${2:-"4"}
+
+function cleanup {
+  kill ${pids[@]} > /dev/null 2>&1
+}
+trap cleanup EXIT
+
+wd=$(dirname "$0")
+logs=$(mktemp -d)
+pids=()
+
+iperf -p 1337 -s > /dev/null 2>&1 &
+pids+=($!)
+
+go build -o $logs/hochwasser $wd/..
+
+$logs/hochwasser -peer :1300 -image $wd/../benchmarks/test.png -host :1337 < /dev/null > $logs/peer0.log 2>&1 &
+pids+=($!)
+for i in $(seq 1 $((numPeers - 1))); do
+  $logs/hochwasser -peer :$((1300 + i)) -seeds :1300 < /dev/null > $logs/peer$i.log 2>&1 &
+  pids+=($!)
+  victim=$!
+done
+
+sleep $runtime
+echo "== swarm of $numPeers peers"
+for i in $(seq 0 $((numPeers - 1))); do
+  echo "peer$i: $(grep -E '^\[peer\] (fluting|[0-9]+ peers)' $logs/peer$i.log | tail -2 | tr '\n' ' ')"
+done
+
+kill $victim
+sleep $runtime
+echo "== after killing peer$((numPeers - 1))"
+for i in $(seq 0 $((numPeers - 2))); do
+  echo "peer$i: $(grep -E '^\[peer\] (fluting|[0-9]+ peers)' $logs/peer$i.log | tail -2 | tr '\n' ' ')"
+done
+
+echo "logs are in $logs"
@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,22 +20,46 @@ import (
 )
 
 var (
-	imgPath        = flag.String("image", "", "Filepath of an image to flut")
+	imgPath        = flag.String("image", "", "Filepath of an image to flut. Animated GIFs, APNGs and directories of numbered PNGs are animated")
 	ránAddr        = flag.String("rán", "", "Start RPC server to distribute jobs, listening on the given address/port")
 	hevringAddr    = flag.String("hevring", "", "Connect to RPC server at given address/port")
+	upstreamAddr   = flag.String("upstream", "", "Connect Rán to an upstream Rán at given address/port, relaying its tasks to our clients")
+	peerAddr       = flag.String("peer", "", "Join a swarm of peers without central Rán, listening on the given address/port")
+	peerSeeds      = flag.String("seeds", "", "Comma separated addresses of peers to join the swarm with")
 	address        = flag.String("host", ":1234", "Target server address")
 	connections    = flag.Int("connections", 4, "Number of simultaneous connections. Each connection posts a subimage")
 	x              = flag.Int("x", 0, "Offset of posted image from left border")
 	y              = flag.Int("y", 0, "Offset of posted image from top border")
+	anchor         = flag.String("anchor", "", "Place the image on the canvas, e.g. center, bottom-right or 25%,50%. Overrides -x and -y")
+	scale          = flag.String("scale", "", "Scale the image by a factor, or to the canvas: fit, fill or stretch")
 	order          = flag.String("order", "rtl", "Draw order (shuffle, ltr, rtl, ttb, btt)")
 	fetchImgPath   = flag.String("fetch", "", "Enable fetching the screen area to the given local file, updating it each second")
 	hevringImgPath = flag.String("hevring-preview", "", "Write the current task image to the given PNG file")
+	webAddr        = flag.String("web", "", "Serve a web dashboard for Rán on the given address/port. Requires -control-token, unless listening on a loopback address")
+	controlAddr    = flag.String("control", "", "Serve the REPL of Rán to remote operators on the given address/port, or unix:<path>")
+	controlFiles   = flag.String("control-files", "", "Directory remote operators & the web dashboard may read files from via img, font, source & playlist load. Without it, they can't access files")
+	controlToken   = flag.String("control-token", os.Getenv("HOCHWASSER_CONTROL_TOKEN"), "Token remote operators have to send as first line, and the web dashboard requires. Defaults to $HOCHWASSER_CONTROL_TOKEN, or a random token printed on startup for TCP control sockets")
+	tasksDir       = flag.String("tasks", "", "Directory to persist stored tasks in. Tasks in there are preloaded")
+	playlistPath   = flag.String("playlist", "", "Play stored tasks according to the given playlist file")
+	scriptPath     = flag.String("script", "", "Run REPL commands from the given file on startup")
+	palettesDir    = flag.String("palettes", "", "Load named palettes from the GIMP .gpl, .hex and .json files in the given directory")
+	videoPath      = flag.String("video", "", "Flut a YUV4MPEG2 or raw RGBA video from the given file or named pipe, or - for stdin. Fluted locally, without Rán")
+	videoSize      = flag.String("video-size", "", "Frame size of raw RGBA video, e.g. 320x240")
+	videoFPS       = flag.Float64("video-fps", 25, "Frame rate of raw RGBA video")
+	videoScale     = flag.Float64("video-scale", 1, "Scale factor applied to the video frames")
 	cpuprofile     = flag.String("cpuprofile", "", "Destination file for CPU Profile")
 )
 
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
+	if *palettesDir != "" {
+		names, err := render.LoadPalettes(*palettesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("loaded %d palettes from %s: %s\n", len(names), *palettesDir, strings.Join(names, ", "))
+	}
 	task := runWithExitHandler(taskFromFlags)
 	if *cpuprofile != "" {
 		runWithProfiler(*cpuprofile, task)
@@ -46,12 +72,32 @@ func taskFromFlags(stop chan bool, wg *sync.WaitGroup) {
 	rán := *ránAddr
 	hev := *hevringAddr
 
+	if *videoPath != "" {
+		flutVideoFromFlags(stop, wg)
+		return
+	}
+
+	if *peerAddr != "" {
+		var seeds []string
+		if *peerSeeds != "" {
+			seeds = strings.Split(*peerSeeds, ",")
+		}
+		p := rpc.JoinSwarm(*peerAddr, seeds, stop, wg)
+		if *imgPath != "" {
+			p.SetTask(flutTaskFromFlags())
+		}
+		if *scriptPath != "" {
+			p.RunScript(*scriptPath)
+		}
+		return
+	}
+
 	startServer := rán != "" || (hev == "" && *imgPath != "")
 	startClient := hev != "" || (rán == "" && *imgPath != "")
 	fetchImg := *fetchImgPath != ""
 
 	if !(startServer || startClient || fetchImg) {
-		fmt.Println("Error: At least one of the following flags is needed:\n	-image -rán -hevring\n")
+		fmt.Print("Error: At least one of the following flags is needed:\n	-image -rán -hevring\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -63,29 +109,41 @@ func taskFromFlags(stop chan bool, wg *sync.WaitGroup) {
 
 	if startServer {
 		r := rpc.SummonRán(rán, stop, wg)
+		if *tasksDir != "" {
+			store, err := rpc.OpenTaskStore(*tasksDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			r.SetTaskStore(store)
+		}
+		r.SetControlFiles(*controlFiles)
+		if *webAddr != "" {
+			r.ServeDashboard(*webAddr, *controlToken)
+		}
+		if *controlAddr != "" {
+			r.ServeControl(*controlAddr, *controlToken)
+		}
 
-		var img *image.NRGBA
-		if *imgPath != "" {
-			var err error
-			if img, err = render.ReadImage(*imgPath); err != nil {
+		r.SetTask(flutTaskFromFlags())
+
+		if *playlistPath != "" {
+			if err := r.StartPlaylist(*playlistPath); err != nil {
 				log.Fatal(err)
 			}
 		}
 
-		r.SetTask(pixelflut.FlutTask{
-			FlutTaskOpts: pixelflut.FlutTaskOpts{
-				Address:     *address,
-				MaxConns:    *connections,
-				Offset:      image.Pt(*x, *y),
-				RenderOrder: pixelflut.NewOrder(*order),
-			},
-			Img: img,
-		})
+		if *scriptPath != "" {
+			r.RunScript(*scriptPath)
+		}
+
+		if *upstreamAddr != "" {
+			r.ConnectUpstream(*upstreamAddr, stop, wg)
+		}
 	}
 
 	if startClient {
 		hevring := rpc.ConnectHevring(hev, stop, wg)
-		hevring.PreviewPath = *hevringImgPath
+		hevring.SetPreviewPath(*hevringImgPath)
 	}
 
 	if fetchImg {
@@ -93,13 +151,97 @@ func taskFromFlags(stop chan bool, wg *sync.WaitGroup) {
 	}
 }
 
+func flutTaskFromFlags() pixelflut.FlutTask {
+	t := pixelflut.FlutTask{
+		FlutTaskOpts: pixelflut.FlutTaskOpts{
+			Address:     *address,
+			MaxConns:    *connections,
+			Offset:      image.Pt(*x, *y),
+			RenderOrder: pixelflut.NewOrder(*order),
+		},
+	}
+	if *anchor != "" {
+		a, err := render.ParseAnchor(*anchor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t.Anchor = &a
+	}
+	if *imgPath != "" {
+		anim, err := render.ReadAnimation(*imgPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t.SetAnimation(anim)
+		if *scale != "" {
+			t.MapFrames(scaleFromFlags())
+		}
+	}
+	return t
+}
+
+// scaleFromFlags returns a function scaling by the factor or fit mode of -scale
+func scaleFromFlags() func(*image.NRGBA) *image.NRGBA {
+	if f, err := strconv.ParseFloat(*scale, 64); err == nil && f > 0 {
+		return func(img *image.NRGBA) *image.NRGBA { return render.ScaleImage(img, f, f, true) }
+	}
+	mode, err := render.NewFitMode(*scale)
+	if err != nil {
+		log.Fatalf("invalid -scale '%s', expected a positive factor, fit, fill or stretch", *scale)
+	}
+	canvas, err := pixelflut.CanvasSize(*address)
+	if err != nil {
+		log.Fatalf("can't determine canvas size for -scale %s: %s", *scale, err)
+	}
+	return func(img *image.NRGBA) *image.NRGBA { return render.FitImage(img, canvas, mode, true) }
+}
+
+func flutVideoFromFlags(stop chan bool, wg *sync.WaitGroup) {
+	in := os.Stdin
+	if *videoPath != "-" {
+		f, err := os.Open(*videoPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		in = f
+	}
+
+	var size image.Point
+	if *videoSize != "" {
+		if _, err := fmt.Sscanf(*videoSize, "%dx%d", &size.X, &size.Y); err != nil {
+			log.Fatalf("invalid -video-size '%s', expected e.g. 320x240", *videoSize)
+		}
+	}
+	if *videoScale <= 0 {
+		log.Fatal("-video-scale must be positive")
+	}
+
+	video, err := render.NewVideo(in, size, *videoFPS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("[video] %v @ %.1f fps\n", video.Size, float64(time.Second)/float64(video.FrameDelay))
+
+	opts := flutTaskFromFlags().FlutTaskOpts
+	wg.Add(1)
+	go pixelflut.FlutVideo(video, opts, *videoScale, stop, wg)
+}
+
 func canvasToFile(filepath, server string, interval time.Duration, stop chan bool, wg *sync.WaitGroup) {
 	// async fetch the image
-	fetchedImg := pixelflut.FetchImage(nil, server, 1, stop)
+	fetchedImg, errs, err := pixelflut.FetchImage(nil, server, 1, stop)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := <-errs; err != nil {
+			log.Fatal(err)
+		}
+	}()
 
 	// write it in a fixed interval
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		for loop := true; loop; {
@@ -119,7 +261,7 @@ func runWithExitHandler(task func(stop chan bool, wg *sync.WaitGroup)) func() {
 	return func() {
 		wg := sync.WaitGroup{}
 		stopChan := make(chan bool)
-		interruptChan := make(chan os.Signal)
+		interruptChan := make(chan os.Signal, 1)
 		signal.Notify(interruptChan, os.Interrupt)
 
 		task(stopChan, &wg)
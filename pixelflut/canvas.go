@@ -2,76 +2,140 @@ package pixelflut
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
+	"fmt"
 	"image"
 	"image/color"
-	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+// canvasSizeTimeout limits how long CanvasSize waits for the server
+const canvasSizeTimeout = 5 * time.Second
+
 // CanvasSize returns the size of the canvas as returned by the server
-func CanvasSize(address string) (int, int) {
-	conn, err := net.Dial("tcp", address)
+func CanvasSize(address string) (image.Point, error) {
+	conn, err := net.DialTimeout("tcp", address, canvasSizeTimeout)
 	if err != nil {
-		log.Fatal(err)
+		return image.Point{}, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(canvasSizeTimeout))
 
-	conn.Write([]byte("SIZE\n"))
+	if _, err = conn.Write([]byte("SIZE\n")); err != nil {
+		return image.Point{}, err
+	}
 	reader := bufio.NewReader(conn)
 	res, err := reader.ReadSlice('\n')
 	if err != nil {
-		log.Fatal(err)
+		return image.Point{}, fmt.Errorf("no canvas size from %s: %w", address, err)
 	}
-	return parseXY(res[5:])
+	if !bytes.HasPrefix(res, []byte("SIZE ")) {
+		return image.Point{}, fmt.Errorf("invalid canvas size from %s: %q", address, res)
+	}
+	x, y := parseXY(res[5:])
+	return image.Pt(x, y), nil
 }
 
 // FetchImage asynchronously uses `conns` to fetch pixels within `bounds` from
 // a pixelflut server at `address`, and writes them into the returned Image.
 // If bounds is nil, the server's entire canvas is fetched.
-func FetchImage(bounds *image.Rectangle, address string, conns int, stop chan bool) (img *image.NRGBA) {
+// Fetching stops when stop is closed, or once a connection fails, in which
+// case the error is sent to errs.
+func FetchImage(bounds *image.Rectangle, address string, conns int, stop chan bool) (img *image.NRGBA, errs <-chan error, err error) {
 	if bounds == nil {
-		x, y := CanvasSize(address)
-		bounds = &image.Rectangle{Max: image.Pt(x, y)}
+		size, err := CanvasSize(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		bounds = &image.Rectangle{Max: size}
+	}
+
+	netConns := make([]net.Conn, conns)
+	for i := range netConns {
+		if netConns[i], err = net.DialTimeout("tcp", address, canvasSizeTimeout); err != nil {
+			for _, c := range netConns[:i] {
+				c.Close()
+			}
+			return nil, nil, err
+		}
 	}
 
 	img = image.NewNRGBA(*bounds)
 	cmds := cmdsFetchImage(*bounds).Chunk(conns)
+	errChan := make(chan error, 1)
+	failed := make(chan bool)
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			errChan <- err
+			close(failed)
+		})
+	}
 
-	for i := 0; i < conns; i++ {
-		conn, err := net.Dial("tcp", address)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		go readPixels(img, conn, stop)
-		go bombConn(cmds[i], 0, 0, conn, stop)
+	for i, conn := range netConns {
+		go func(conn net.Conn) {
+			// unblock the reader & writer of the connection
+			select {
+			case <-stop:
+			case <-failed:
+			}
+			conn.Close()
+		}(conn)
+		go func(conn net.Conn) {
+			if err := readPixels(img, conn, stop); err != nil {
+				fail(err)
+			}
+		}(conn)
+		go func(conn net.Conn, cmds []byte) {
+			if err := bombConn(newConnFeed(cmds), 0, 0, conn, stop); err != nil && !isClosed(stop) {
+				fail(err)
+			}
+		}(conn, cmds[i])
 	}
 
-	return img
+	return img, errChan, nil
 }
 
-func readPixels(target *image.NRGBA, conn net.Conn, stop chan bool) {
+func readPixels(target *image.NRGBA, conn net.Conn, stop chan bool) error {
 	reader := bufio.NewReader(conn)
 	col := make([]byte, 4)
 	for {
-		select {
-		case <-stop:
-			return
-
-		default:
-			res, err := reader.ReadSlice('\n')
-			if err != nil {
-				log.Fatal(err)
+		res, err := reader.ReadSlice('\n')
+		if err != nil {
+			if isClosed(stop) {
+				return nil
 			}
+			return err
+		}
 
-			// parse response ("PX <x> <y> <rrggbb>")
-			colorStart := len(res) - 7
-			x, y := parseXY(res[3:colorStart])
-			hex.Decode(col, res[colorStart:len(res)-1])
-
-			target.SetNRGBA(x, y, color.NRGBA{col[0], col[1], col[2], col[3]})
+		// parse response ("PX <x> <y> <rrggbb>"), the color may include alpha
+		res = bytes.TrimRight(res, "\r\n")
+		colorStart := bytes.LastIndexByte(res, ' ') + 1
+		if colorStart < 4 {
+			return fmt.Errorf("invalid pixel response %q", res)
+		}
+		x, y := parseXY(res[3:colorStart])
+		n, err := hex.Decode(col, res[colorStart:])
+		if err != nil || n < 3 {
+			return fmt.Errorf("invalid pixel response %q", res)
+		}
+		if n == 3 {
+			col[3] = 0xff
 		}
+		target.SetNRGBA(x, y, color.NRGBA{col[0], col[1], col[2], col[3]})
+	}
+}
+
+// isClosed reports whether the channel c is closed
+func isClosed(c chan bool) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -71,6 +71,9 @@ func commandsFromImage(img *image.NRGBA, order RenderOrder, offset image.Point)
 			if c.A == 0 {
 				continue
 			}
+			if x+offset.X < 0 || y+offset.Y < 0 {
+				continue // outside the canvas, eg. grown by effects
+			}
 
 			var cmd []byte
 			cmd = append(cmd, []byte("PX ")...)
@@ -3,7 +3,6 @@ package pixelflut
 import (
 	"fmt"
 	"image"
-	"image/color"
 	"sync"
 	"time"
 
@@ -14,6 +13,9 @@ import (
 type FlutTask struct {
 	FlutTaskOpts
 	Img FlutTaskData
+	// Anim optionally animates the task, by cycling through its frames.
+	// Img is expected to be its first frame.
+	Anim *render.Animation
 }
 
 // FlutTaskOpts specifies parameters of the flut
@@ -21,8 +23,9 @@ type FlutTaskOpts struct {
 	Address     string
 	MaxConns    int
 	Offset      image.Point
+	Anchor      *render.Anchor // if set, Offset is derived by placing Img on the canvas
 	Paused      bool
-	RGBSplit    bool // @cleanup: replace with `FX: []Effect`
+	FX          render.FX // effects applied to each frame before fluting
 	RandOffset  bool
 	RenderOrder RenderOrder
 }
@@ -35,12 +38,43 @@ func (t FlutTask) String() string {
 	if t.Img != nil {
 		img = t.Img.Bounds().Size().String()
 	}
+	if t.IsAnimated() {
+		img += fmt.Sprintf(" × %d frames", len(t.Anim.Frames))
+	}
+	offset := t.Offset.String()
+	if t.Anchor != nil {
+		offset = t.Anchor.String()
+	}
 	return fmt.Sprintf(
-		"	%d conns @ %s\n	img %v	offset %v\n	order %s	rgbsplit %v	randoffset %v	paused %v",
-		t.MaxConns, t.Address, img, t.Offset, t.RenderOrder, t.RGBSplit, t.RandOffset, t.Paused,
+		"	%d conns @ %s\n	img %v	offset %v\n	order %s	randoffset %v	paused %v\n	fx %v",
+		t.MaxConns, t.Address, img, offset, t.RenderOrder, t.RandOffset, t.Paused, t.FX,
 	)
 }
 
+// IsAnimated indicates if the task has more than one frame
+func (t FlutTask) IsAnimated() bool {
+	return t.Anim != nil && len(t.Anim.Frames) > 1
+}
+
+// SetAnimation sets the frames of a as the task's image. Animations with a
+// single frame are fluted as still image.
+func (t *FlutTask) SetAnimation(a *render.Animation) {
+	t.Img, t.Anim = a.Frames[0], nil
+	if len(a.Frames) > 1 {
+		t.Anim = a
+	}
+}
+
+// MapFrames applies fn to the image and all frames of the task
+func (t *FlutTask) MapFrames(fn func(FlutTaskData) FlutTaskData) {
+	if !t.IsAnimated() {
+		t.Img = fn(t.Img)
+		return
+	}
+	t.Anim = t.Anim.Map(fn)
+	t.Img = t.Anim.Frames[0]
+}
+
 // IsFlutable indicates if a task is properly initialized & not paused
 func (t FlutTask) IsFlutable() bool {
 	return t.Img != nil && t.MaxConns > 0 && t.Address != "" && !t.Paused
@@ -51,6 +85,14 @@ type RenderOrder uint8
 func (t RenderOrder) String() string   { return []string{"→", "↓", "←", "↑", "random"}[t] }
 func (t RenderOrder) IsVertical() bool { return t&0b01 != 0 }
 func (t RenderOrder) IsReverse() bool  { return t&0b10 != 0 }
+
+// MarshalText encodes the order in a human readable form, which is parsed by UnmarshalText
+func (t RenderOrder) MarshalText() ([]byte, error) { return []byte(t.String()), nil }
+func (t *RenderOrder) UnmarshalText(v []byte) error {
+	*t = NewOrder(string(v))
+	return nil
+}
+
 func NewOrder(v string) RenderOrder {
 	switch v {
 	case "ltr", "l", "→":
@@ -80,29 +122,44 @@ func Flut(t FlutTask, stop chan bool, wg *sync.WaitGroup) {
 		return // @robustness: actually return an error here?
 	}
 
-	cmds := generateCommands(t)
+	// apply effects upfront, as the anchor depends on the size of the result
+	if len(t.FX) > 0 {
+		t.MapFrames(t.FX.Apply)
+		t.FX = nil
+	}
+	frames := []FlutTaskData{t.Img}
+	var delays []time.Duration
+	if t.IsAnimated() {
+		frames, delays = t.Anim.Frames, t.Anim.Delays
+	}
 
-	var messages [][]byte
-	var maxOffsetX, maxOffsetY int
+	maxOffset := place(&t)
+	numChunks := t.MaxConns
 	if t.RandOffset {
-		maxX, maxY := CanvasSize(t.Address)
-		maxOffsetX = maxX - t.Img.Bounds().Canon().Dx()
-		maxOffsetY = maxY - t.Img.Bounds().Canon().Dy()
-		messages = cmds.Chunk(1) // each connection should send the full img
-	} else {
-		messages = cmds.Chunk(t.MaxConns)
+		numChunks = 1 // each connection should send the full img
+	}
+
+	// messages of each frame for each connection
+	messages := make([][][]byte, len(frames))
+	for i, frame := range frames {
+		ft := t
+		ft.Img = frame
+		messages[i] = generateCommands(ft).Chunk(numChunks)
 	}
 
+	// each connection sends the message of the current frame
+	current := make([]*connFeed, t.MaxConns)
 	bombWg := sync.WaitGroup{}
-	for i := 0; i < t.MaxConns; i++ {
-		msg := messages[0]
-		if len(messages) > i {
-			msg = messages[i]
-		}
+	for i := range current {
+		current[i] = newConnFeed(connMessage(messages[0], i))
 
 		time.Sleep(50 * time.Millisecond) // avoid crashing the server
 
-		go bombAddress(msg, t.Address, maxOffsetX, maxOffsetY, stop, &bombWg)
+		bombWg.Add(1)
+		go bombAddress(current[i], t.Address, maxOffset.X, maxOffset.Y, stop, &bombWg)
+	}
+	if len(frames) > 1 {
+		go animate(messages, delays, current, stop)
 	}
 	bombWg.Wait()
 	if wg != nil {
@@ -110,16 +167,51 @@ func Flut(t FlutTask, stop chan bool, wg *sync.WaitGroup) {
 	}
 }
 
+// place resolves the anchor of t to an offset, and returns the range of
+// random offsets. Both depend on the canvas size, which is only queried if needed.
+// Effects must be applied to t.Img already, as they may change its bounds.
+func place(t *FlutTask) (maxOffset image.Point) {
+	if t.Anchor == nil && !t.RandOffset {
+		return image.Point{}
+	}
+	canvas, err := CanvasSize(t.Address)
+	if err != nil {
+		fmt.Printf("[net] can't place image, using offset %v: %s\n", t.Offset, err)
+		return image.Point{}
+	}
+	b := t.Img.Bounds()
+	if t.Anchor != nil {
+		t.Offset = t.Anchor.Offset(canvas, b.Size()).Sub(b.Min)
+	}
+	if t.RandOffset {
+		maxOffset = canvas.Sub(b.Size())
+	}
+	return maxOffset
+}
+
+func connMessage(messages [][]byte, conn int) []byte {
+	if conn < len(messages) {
+		return messages[conn]
+	}
+	return messages[0]
+}
+
+// animate switches the message of each connection to the next frame after
+// each frame's delay, until stop is closed.
+func animate(messages [][][]byte, delays []time.Duration, current []*connFeed, stop chan bool) {
+	for frame := 0; ; frame = (frame + 1) % len(messages) {
+		select {
+		case <-stop:
+			return
+		case <-time.After(delays[frame]):
+		}
+		next := (frame + 1) % len(messages)
+		for i, c := range current {
+			c.set(connMessage(messages[next], i))
+		}
+	}
+}
+
 func generateCommands(t FlutTask) (cmds commands) {
-	if t.RGBSplit {
-		white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
-		imgmod := render.ImgColorFilter(t.Img, white, color.NRGBA{0xff, 0, 0, 0xff})
-		cmds = append(cmds, commandsFromImage(imgmod, t.RenderOrder, t.Offset.Add(image.Pt(-10, -10)))...)
-		imgmod = render.ImgColorFilter(t.Img, white, color.NRGBA{0, 0xff, 0, 0xff})
-		cmds = append(cmds, commandsFromImage(imgmod, t.RenderOrder, t.Offset.Add(image.Pt(10, 0)))...)
-		imgmod = render.ImgColorFilter(t.Img, white, color.NRGBA{0, 0, 0xff, 0xff})
-		cmds = append(cmds, commandsFromImage(imgmod, t.RenderOrder, t.Offset.Add(image.Pt(-10, 10)))...)
-	}
-	cmds = append(cmds, commandsFromImage(t.Img, t.RenderOrder, t.Offset)...)
-	return
+	return commandsFromImage(t.FX.Apply(t.Img), t.RenderOrder, t.Offset)
 }
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,11 +21,39 @@ type Performance struct {
 	BytesPerSec int
 	BytesTotal  int
 
+	mu            *sync.Mutex // guards the exported fields of the reporter
+	enabled       int32       // atomic, read in the hot loop
 	connsReporter chan int
 	bytesReporter chan int
 	bytes         int
 }
 
+// Snapshot returns a copy of the current metrics. Safe for concurrent use.
+func (p *Performance) Snapshot() Performance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Performance{
+		Enabled:     p.isEnabled(),
+		Conns:       p.Conns,
+		BytesPerSec: p.BytesPerSec,
+		BytesTotal:  p.BytesTotal,
+	}
+}
+
+// SetEnabled toggles the collection of metrics. Safe for concurrent use.
+func (p *Performance) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&p.enabled, v)
+	p.mu.Lock()
+	p.Enabled = enabled
+	p.mu.Unlock()
+}
+
+func (p *Performance) isEnabled() bool { return atomic.LoadInt32(&p.enabled) == 1 }
+
 func (p Performance) String() string {
 	return fmt.Sprintf("%v conns\t%v\t%v/s",
 		p.Conns, fmtBytes(p.BytesTotal), fmtBit(p.BytesPerSec))
@@ -60,13 +89,15 @@ func fmtBit(b int) string {
 		float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-// PerformanceReporter provides pixelflut performance metrics, when Enabled is true.
+// PerformanceReporter provides pixelflut performance metrics, when enabled via SetEnabled.
+// Read its metrics via Snapshot.
 //   @speed: Note that enabling  costs ~9% bomb performance under high throughput.
 var PerformanceReporter = initPerfReporter()
 
 // should be called only once
 func initPerfReporter() *Performance {
 	r := new(Performance)
+	r.mu = new(sync.Mutex)
 	r.bytesReporter = make(chan int, 512)
 	r.connsReporter = make(chan int, 512)
 
@@ -74,28 +105,50 @@ func initPerfReporter() *Performance {
 		for {
 			select {
 			case b := <-r.bytesReporter:
+				r.mu.Lock()
 				r.bytes += b
 				r.BytesTotal += b
+				r.mu.Unlock()
 			case c := <-r.connsReporter:
+				r.mu.Lock()
 				r.Conns += c
+				r.mu.Unlock()
 			}
 		}
 	}()
 	go func() {
 		for {
 			time.Sleep(time.Second)
+			r.mu.Lock()
 			r.BytesPerSec = r.bytes
 			r.bytes = 0
+			r.mu.Unlock()
 		}
 	}()
 
 	return r
 }
 
-// bombAddress opens a TCP connection to `address`, and writes `message` repeatedly, until `stop` is closed.
+// connFeed holds the message a connection writes repeatedly. The message may
+// be replaced concurrently, taking effect on the next write.
+type connFeed struct {
+	passes uint64 // number of complete writes, accessed atomically. first field for 64bit alignment
+	msg    atomic.Value
+}
+
+func newConnFeed(msg []byte) *connFeed {
+	f := new(connFeed)
+	f.msg.Store(msg)
+	return f
+}
+
+func (f *connFeed) set(msg []byte) { f.msg.Store(msg) }
+
+func (f *connFeed) numPasses() uint64 { return atomic.LoadUint64(&f.passes) }
+
+// bombAddress opens a TCP connection to `address`, and writes the message of `feed` repeatedly, until `stop` is closed.
 // It retries with exponential backoff on network errors.
-func bombAddress(message []byte, address string, maxOffsetX, maxOffsetY int, stop chan bool, wg *sync.WaitGroup) {
-	wg.Add(1)
+func bombAddress(feed *connFeed, address string, maxOffsetX, maxOffsetY int, stop chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	timeout := timeoutMin
@@ -115,7 +168,7 @@ func bombAddress(message []byte, address string, maxOffsetX, maxOffsetY int, sto
 
 		fmt.Printf("[net] bombing %s with new connection\n", address)
 
-		err = bombConn(message, maxOffsetX, maxOffsetY, conn, stop)
+		err = bombConn(feed, maxOffsetX, maxOffsetY, conn, stop)
 		conn.Close()
 		timeout = timeoutMin
 		if err == nil {
@@ -125,14 +178,12 @@ func bombAddress(message []byte, address string, maxOffsetX, maxOffsetY int, sto
 	}
 }
 
-// bombConn writes the given message to the given connection in a tight loop, until `stop` is closed.
+// bombConn writes the message of feed to the given connection in a tight loop, until `stop` is closed.
 // Does no transformation on the given message, so make sure packet splitting / nagle works.
-func bombConn(message []byte, maxOffsetX, maxOffsetY int, conn net.Conn, stop chan bool) error {
+func bombConn(feed *connFeed, maxOffsetX, maxOffsetY int, conn net.Conn, stop chan bool) error {
 	PerformanceReporter.connsReporter <- 1
 	defer func() { PerformanceReporter.connsReporter <- -1 }()
 
-	var msg = make([]byte, len(message)+16) // leave some space for offset cmd
-	msg = message
 	randOffset := maxOffsetX > 0 && maxOffsetY > 0
 
 	for {
@@ -140,6 +191,8 @@ func bombConn(message []byte, maxOffsetX, maxOffsetY int, conn net.Conn, stop ch
 		case <-stop:
 			return nil
 		default:
+			message := feed.msg.Load().([]byte)
+			msg := message
 			if randOffset {
 				msg = append(
 					OffsetCmd(rand.Intn(maxOffsetX), rand.Intn(maxOffsetY)),
@@ -150,7 +203,8 @@ func bombConn(message []byte, maxOffsetX, maxOffsetY int, conn net.Conn, stop ch
 			if err != nil {
 				return err
 			}
-			if PerformanceReporter.Enabled {
+			atomic.AddUint64(&feed.passes, 1)
+			if PerformanceReporter.isEnabled() {
 				PerformanceReporter.bytesReporter <- b
 			}
 		}
@@ -0,0 +1,163 @@
+package pixelflut
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+// FlutVideo asynchronously flutes the frames of v with the given options at
+// the video's frame rate, until `stop` is closed. Frames are scaled by `scale`.
+// When the connections can't keep up, frames are dropped: a new frame is only
+// sent once each connection has sent the previous one completely.
+// After the end of the stream, the last frame is fluted until `stop` is closed.
+func FlutVideo(v *render.Video, opts FlutTaskOpts, scale float64, stop chan bool, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	frames := make(chan *image.NRGBA, 1)
+	go readVideo(v, frames, stop)
+
+	encode := func(frame *image.NRGBA) (FlutTask, [][]byte) {
+		t := FlutTask{FlutTaskOpts: opts, Img: frame}
+		if scale != 1 {
+			t.Img = render.ScaleImage(frame, scale, scale, true)
+		}
+		// apply effects here instead of in generateCommands, so place sees their bounds
+		t.Img, t.FX = t.FX.Apply(t.Img), nil
+		numChunks := t.MaxConns
+		if t.RandOffset {
+			numChunks = 1
+		}
+		return t, generateCommands(t).Chunk(numChunks)
+	}
+
+	var first *image.NRGBA
+	select {
+	case <-stop:
+		return
+	case first = <-frames:
+		if first == nil {
+			return // stream ended without any frame
+		}
+	}
+	t, messages := encode(first)
+
+	maxOffset := place(&t)
+	if t.Anchor != nil {
+		// frames are encoded with the offset of the task, so resolve it once
+		opts.Offset, opts.Anchor = t.Offset, nil
+		t, messages = encode(first)
+	}
+
+	current := make([]*connFeed, t.MaxConns)
+	bombWg := sync.WaitGroup{}
+	for i := range current {
+		current[i] = newConnFeed(connMessage(messages, i))
+		time.Sleep(50 * time.Millisecond) // avoid crashing the server
+		bombWg.Add(1)
+		go bombAddress(current[i], t.Address, maxOffset.X, maxOffset.Y, stop, &bombWg)
+	}
+
+	shown := 1
+	for {
+		// wait until the current frame was sent completely by each connection,
+		// meanwhile newer frames replace the pending one.
+		if !awaitPass(current, stop) {
+			break
+		}
+		var frame *image.NRGBA
+		select {
+		case <-stop:
+		case frame = <-frames:
+		}
+		if frame == nil {
+			break
+		}
+		_, messages = encode(frame)
+		for i, c := range current {
+			c.set(connMessage(messages, i))
+		}
+		shown++
+	}
+	fmt.Printf("[video] sent %d frames\n", shown)
+	bombWg.Wait()
+}
+
+// maxPassWait limits how long a frame waits for stalled connections
+const maxPassWait = time.Second
+
+// awaitPass blocks until each feed has completed a write of its current
+// message, returning false if stop was closed meanwhile.
+func awaitPass(feeds []*connFeed, stop chan bool) bool {
+	start := make([]uint64, len(feeds))
+	for i, f := range feeds {
+		start[i] = f.numPasses()
+	}
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(maxPassWait)
+	for i, f := range feeds {
+		// the write in progress during the call may have started before the
+		// message was replaced, so wait for the one after it.
+		for f.numPasses() < start[i]+2 {
+			select {
+			case <-stop:
+				return false
+			case <-timeout:
+				return true
+			case <-ticker.C:
+			}
+		}
+	}
+	return true
+}
+
+// readVideo reads frames of v at its frame rate, offering only the most
+// recent one on `frames`. Frames that weren't consumed in time are dropped.
+// `frames` is closed at the end of the stream.
+func readVideo(v *render.Video, frames chan *image.NRGBA, stop chan bool) {
+	defer close(frames)
+	var read, dropped int
+	start := time.Now()
+	for ; ; read++ {
+		frame, err := v.ReadFrame()
+		if err == io.EOF {
+			fmt.Printf("[video] end of stream after %d frames, dropped %d\n", read, dropped)
+			return
+		} else if err != nil {
+			fmt.Printf("[video] error reading frame %d: %s\n", read, err)
+			return
+		}
+
+		due := start.Add(time.Duration(read) * v.FrameDelay)
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		} else if -wait > v.FrameDelay {
+			// the stream is slower than its frame rate (e.g. a live source), resync
+			start = time.Now().Add(-time.Duration(read) * v.FrameDelay)
+		}
+
+		select {
+		case stale := <-frames:
+			if stale != nil {
+				dropped++
+			}
+		default:
+		}
+		select {
+		case frames <- frame:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Adjustments return a modified copy of the image, keeping its alpha.
+// Brightness, contrast & gamma operate on sRGB values via lookup tables,
+// saturation & hue via color matrices, similar to CSS filters.
+
+// AdjustBrightness adds delta in [-1,1] to each color channel
+func AdjustBrightness(img *image.NRGBA, delta float64) *image.NRGBA {
+	return applyLUT(img, func(v float64) float64 { return v + delta })
+}
+
+// AdjustContrast scales the distance of each color channel from the middle
+// gray by factor. 0 yields gray, 1 keeps the image unchanged.
+func AdjustContrast(img *image.NRGBA, factor float64) *image.NRGBA {
+	return applyLUT(img, func(v float64) float64 { return (v-0.5)*factor + 0.5 })
+}
+
+// AdjustGamma applies a gamma curve to each color channel. Values above 1
+// brighten the midtones, values below 1 darken them.
+func AdjustGamma(img *image.NRGBA, gamma float64) *image.NRGBA {
+	return applyLUT(img, func(v float64) float64 { return math.Pow(v, 1/gamma) })
+}
+
+// AdjustSaturation scales the saturation by factor. 0 yields grayscale, 1
+// keeps the image unchanged, larger values intensify the colors.
+func AdjustSaturation(img *image.NRGBA, factor float64) *image.NRGBA {
+	s := factor
+	return applyMatrix(img, [9]float64{
+		0.213 + 0.787*s, 0.715 - 0.715*s, 0.072 - 0.072*s,
+		0.213 - 0.213*s, 0.715 + 0.285*s, 0.072 - 0.072*s,
+		0.213 - 0.213*s, 0.715 - 0.715*s, 0.072 + 0.928*s,
+	})
+}
+
+// RotateHue shifts the hue of each pixel by deg degrees, keeping its luminance
+func RotateHue(img *image.NRGBA, deg float64) *image.NRGBA {
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	return applyMatrix(img, [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	})
+}
+
+// ChromaKey makes pixels similar to key transparent. tolerance is the maximum
+// RGB distance in [0,1] of keyed pixels. Pixels up to softness beyond it
+// become partially transparent, to smooth the edges of the remaining content.
+func ChromaKey(img *image.NRGBA, key color.NRGBA, tolerance, softness float64) *image.NRGBA {
+	return keyPixels(img, func(c color.NRGBA) float64 {
+		dr, dg, db := float64(c.R)-float64(key.R), float64(c.G)-float64(key.G), float64(c.B)-float64(key.B)
+		dist := math.Sqrt(dr*dr+dg*dg+db*db) / (255 * math.Sqrt(3))
+		return keyAlpha(dist, tolerance, softness)
+	})
+}
+
+// LumaKey makes pixels with a luminance within [min,max] transparent, where
+// 0 is black and 1 is white.
+func LumaKey(img *image.NRGBA, min, max float64) *image.NRGBA {
+	return keyPixels(img, func(c color.NRGBA) float64 {
+		if l := luminance(c); l >= min && l <= max {
+			return 0
+		}
+		return 1
+	})
+}
+
+// keyAlpha returns the factor of the alpha of a pixel at distance dist from the key
+func keyAlpha(dist, tolerance, softness float64) float64 {
+	switch {
+	case dist <= tolerance:
+		return 0
+	case dist >= tolerance+softness:
+		return 1
+	}
+	return (dist - tolerance) / softness
+}
+
+func luminance(c color.NRGBA) float64 {
+	return (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+}
+
+// keyPixels multiplies the alpha of each pixel with the factor returned by fn
+func keyPixels(img *image.NRGBA, fn func(color.NRGBA) float64) *image.NRGBA {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		if c.A == 0 {
+			return c
+		}
+		if f := fn(c); f < 1 {
+			c.A = uint8(float64(c.A)*f + 0.5)
+		}
+		if c.A == 0 {
+			return color.NRGBA{}
+		}
+		return c
+	})
+}
+
+// applyLUT maps each color channel through fn, which operates on values in [0,1]
+func applyLUT(img *image.NRGBA, fn func(v float64) float64) *image.NRGBA {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = clamp8(fn(float64(i)/255) * 255)
+	}
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{lut[c.R], lut[c.G], lut[c.B], c.A}
+	})
+}
+
+// applyMatrix multiplies the rgb vector of each pixel with the row major 3x3 matrix m
+func applyMatrix(img *image.NRGBA, m [9]float64) *image.NRGBA {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			clamp8(m[0]*r + m[1]*g + m[2]*b),
+			clamp8(m[3]*r + m[4]*g + m[5]*b),
+			clamp8(m[6]*r + m[7]*g + m[8]*b),
+			c.A,
+		}
+	})
+}
@@ -0,0 +1,457 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultFrameDelay is used for frames that don't specify a delay
+const DefaultFrameDelay = 100 * time.Millisecond
+
+// Animation is a sequence of frames, each fully composited and of equal bounds
+type Animation struct {
+	Frames []*image.NRGBA
+	Delays []time.Duration // how long each frame is shown
+}
+
+// Map returns a new Animation with fn applied to each frame
+func (a *Animation) Map(fn func(*image.NRGBA) *image.NRGBA) *Animation {
+	m := &Animation{
+		Frames: make([]*image.NRGBA, len(a.Frames)),
+		Delays: append([]time.Duration(nil), a.Delays...),
+	}
+	for i, f := range a.Frames {
+		m.Frames[i] = fn(f)
+	}
+	return m
+}
+
+// Duration returns the length of a single loop of the animation
+func (a *Animation) Duration() (d time.Duration) {
+	for _, delay := range a.Delays {
+		d += delay
+	}
+	return
+}
+
+// ReadAnimation reads an animated GIF or APNG, or a directory of numbered PNGs
+// (see ReadFrameDir). Other images are returned as a single frame.
+func ReadAnimation(path string) (*Animation, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return ReadFrameDir(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeAnimation(f)
+}
+
+// DecodeAnimation decodes an animated GIF or APNG from reader. Other image
+// formats are returned as a single frame.
+func DecodeAnimation(reader io.Reader) (*Animation, error) {
+	r := bufio.NewReader(reader)
+	magic, _ := r.Peek(len(pngSignature))
+	switch {
+	case bytes.HasPrefix(magic, []byte("GIF8")):
+		return DecodeGIF(r)
+	case bytes.Equal(magic, []byte(pngSignature)):
+		return DecodeAPNG(r)
+	}
+	img, err := DecodeImage(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Animation{Frames: []*image.NRGBA{img}, Delays: []time.Duration{DefaultFrameDelay}}, nil
+}
+
+// DecodeGIF decodes all frames of a GIF, compositing them according to their
+// disposal methods.
+func DecodeGIF(r io.Reader) (*Animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Animation{}
+	c := newCompositor(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		dispose := disposeNone
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				dispose = disposeBackground
+			case gif.DisposalPrevious:
+				dispose = disposePrevious
+			}
+		}
+		a.Frames = append(a.Frames, c.add(frame, frame.Bounds(), draw.Over, dispose))
+
+		delay := DefaultFrameDelay
+		// like browsers, treat very short delays as unspecified
+		if i < len(g.Delay) && g.Delay[i] > 1 {
+			delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		a.Delays = append(a.Delays, delay)
+	}
+	return a, nil
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// apngFrame collects the chunks of a single frame of an APNG
+type apngFrame struct {
+	rect    image.Rectangle
+	delay   time.Duration
+	dispose disposal
+	blend   draw.Op
+	data    [][]byte // image data, as in IDAT chunks
+	hasFCTL bool     // false for the default image, if it isn't part of the animation
+}
+
+// DecodeAPNG decodes all frames of an animated PNG, compositing them according
+// to their dispose & blend operations. PNGs without animation are returned as
+// a single frame.
+func DecodeAPNG(r io.Reader) (*Animation, error) {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+	if string(sig) != pngSignature {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+
+	var header []pngChunk // chunks preceding the image data, shared by all frames
+	var frames []*apngFrame
+	var current *apngFrame
+	seenIDAT := false
+
+	for {
+		chunk, err := readPNGChunk(r)
+		if err != nil {
+			return nil, err
+		}
+		switch chunk.typ {
+		case "IEND":
+			return composeAPNG(header, frames)
+
+		case "acTL":
+			// the number of plays is ignored, animations are looped forever
+
+		case "fcTL":
+			f, err := parseFCTL(chunk.data)
+			if err != nil {
+				return nil, err
+			}
+			current = f
+			frames = append(frames, f)
+
+		case "IDAT":
+			seenIDAT = true
+			if current != nil {
+				current.data = append(current.data, chunk.data)
+			} else {
+				// the default image is not part of the animation, or the PNG is not animated
+				frames = append(frames, &apngFrame{data: [][]byte{chunk.data}})
+				current = frames[len(frames)-1]
+			}
+
+		case "fdAT":
+			if current == nil || len(chunk.data) < 4 {
+				return nil, fmt.Errorf("invalid APNG: unexpected fdAT chunk")
+			}
+			current.data = append(current.data, chunk.data[4:])
+
+		default:
+			if !seenIDAT {
+				header = append(header, chunk)
+			}
+		}
+	}
+}
+
+func readPNGChunk(r io.Reader) (c pngChunk, err error) {
+	var head [8]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	if length > 1<<30 {
+		return c, fmt.Errorf("invalid PNG: chunk too large")
+	}
+	c.typ = string(head[4:])
+	c.data = make([]byte, length+4) // including crc
+	if _, err = io.ReadFull(r, c.data); err != nil {
+		return
+	}
+	c.data = c.data[:length]
+	return
+}
+
+func parseFCTL(d []byte) (*apngFrame, error) {
+	if len(d) != 26 {
+		return nil, fmt.Errorf("invalid APNG: fcTL chunk of length %d", len(d))
+	}
+	be := binary.BigEndian
+	w, h := int(be.Uint32(d[4:])), int(be.Uint32(d[8:]))
+	x, y := int(be.Uint32(d[12:])), int(be.Uint32(d[16:]))
+	num, den := be.Uint16(d[20:]), be.Uint16(d[22:])
+	if den == 0 {
+		den = 100
+	}
+	f := &apngFrame{
+		rect:    image.Rect(x, y, x+w, y+h),
+		delay:   time.Duration(num) * time.Second / time.Duration(den),
+		dispose: disposal(d[24]),
+		blend:   draw.Src,
+		hasFCTL: true,
+	}
+	if f.delay <= 10*time.Millisecond {
+		f.delay = DefaultFrameDelay
+	}
+	if d[25] == 1 {
+		f.blend = draw.Over
+	}
+	if f.dispose > disposePrevious {
+		return nil, fmt.Errorf("invalid APNG: unknown dispose op %d", f.dispose)
+	}
+	return f, nil
+}
+
+func composeAPNG(header []pngChunk, frames []*apngFrame) (*Animation, error) {
+	var ihdr []byte
+	for _, c := range header {
+		if c.typ == "IHDR" {
+			ihdr = c.data
+		}
+	}
+	if len(ihdr) != 13 {
+		return nil, fmt.Errorf("invalid PNG: missing IHDR")
+	}
+	be := binary.BigEndian
+	bounds := image.Rect(0, 0, int(be.Uint32(ihdr[0:])), int(be.Uint32(ihdr[4:])))
+
+	a := &Animation{}
+	c := newCompositor(bounds)
+	for _, f := range frames {
+		if !f.hasFCTL {
+			if len(frames) > 1 {
+				continue // default image that is not part of the animation
+			}
+			// regular PNG
+			f.rect, f.delay, f.blend = bounds, DefaultFrameDelay, draw.Src
+		}
+		if len(a.Frames) == 0 && f.dispose == disposePrevious {
+			f.dispose = disposeBackground
+		}
+
+		// decode the frame as standalone PNG, using the header of the full image
+		img, err := png.Decode(bytes.NewReader(encodePNG(header, f.data, &f.rect)))
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", len(a.Frames), err)
+		}
+		a.Frames = append(a.Frames, c.add(img, f.rect, f.blend, f.dispose))
+		a.Delays = append(a.Delays, f.delay)
+	}
+	if len(a.Frames) == 0 {
+		return nil, fmt.Errorf("invalid PNG: no image data")
+	}
+	return a, nil
+}
+
+// encodePNG assembles a PNG from the given header chunks and image data. If
+// rect is given, the size in the IHDR chunk is replaced by the size of rect.
+func encodePNG(header []pngChunk, data [][]byte, rect *image.Rectangle) []byte {
+	buf := bytes.NewBufferString(pngSignature)
+	for _, c := range header {
+		if c.typ == "IHDR" && rect != nil {
+			ihdr := append([]byte(nil), c.data...)
+			binary.BigEndian.PutUint32(ihdr[0:], uint32(rect.Dx()))
+			binary.BigEndian.PutUint32(ihdr[4:], uint32(rect.Dy()))
+			c.data = ihdr
+		}
+		writePNGChunk(buf, c.typ, c.data)
+	}
+	for _, d := range data {
+		writePNGChunk(buf, "IDAT", d)
+	}
+	writePNGChunk(buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) {
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(data)))
+	copy(head[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(head[4:])
+	crc.Write(data)
+	w.Write(head[:])
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// ReadFrameDir reads the PNG files in dir as frames, ordered by the number in
+// their file name. The delay of the frames can be given in a file `delays.txt`,
+// containing either a single duration for all frames, or one per line.
+func ReadFrameDir(dir string) (*Animation, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no PNG files in %s", dir)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		ni, nj := fileNumber(files[i]), fileNumber(files[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return files[i] < files[j]
+	})
+
+	delays := []time.Duration{DefaultFrameDelay}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "delays.txt")); err == nil {
+		if delays, err = parseDelays(string(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "delays.txt"), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a := &Animation{}
+	for i, f := range files {
+		img, err := ReadImage(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if len(a.Frames) > 0 && img.Bounds() != a.Frames[0].Bounds() {
+			return nil, fmt.Errorf("%s: bounds %v differ from first frame %v", f, img.Bounds(), a.Frames[0].Bounds())
+		}
+		a.Frames = append(a.Frames, img)
+		if len(delays) == 1 {
+			a.Delays = append(a.Delays, delays[0])
+		} else if i < len(delays) {
+			a.Delays = append(a.Delays, delays[i])
+		} else {
+			return nil, fmt.Errorf("%s: missing delay of frame %d", dir, i+1)
+		}
+	}
+	return a, nil
+}
+
+// WriteFrameDir writes the animation to dir in the format read by ReadFrameDir
+func WriteFrameDir(dir string, a *Animation) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	delays := strings.Builder{}
+	for i, f := range a.Frames {
+		if err := WriteImage(filepath.Join(dir, fmt.Sprintf("%04d.png", i)), f); err != nil {
+			return err
+		}
+		fmt.Fprintln(&delays, a.Delays[i])
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "delays.txt"), []byte(delays.String()), 0644)
+}
+
+// fileNumber returns the last number in the file name of path, or -1
+func fileNumber(path string) int {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	end := strings.LastIndexAny(name, "0123456789") + 1
+	start := end
+	for start > 0 && name[start-1] >= '0' && name[start-1] <= '9' {
+		start--
+	}
+	n, err := strconv.Atoi(name[start:end])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func parseDelays(s string) (delays []time.Duration, err error) {
+	for _, line := range strings.Fields(s) {
+		d, err := time.ParseDuration(line)
+		if err != nil {
+			return nil, err
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) == 0 {
+		return nil, fmt.Errorf("no delays given")
+	}
+	return delays, nil
+}
+
+type disposal uint8
+
+// disposal operations, as numbered by APNG
+const (
+	disposeNone disposal = iota
+	disposeBackground
+	disposePrevious
+)
+
+// compositor renders the frames of an animation, where each frame only
+// updates a part of the canvas.
+type compositor struct {
+	canvas *image.NRGBA
+}
+
+func newCompositor(bounds image.Rectangle) *compositor {
+	return &compositor{canvas: image.NewNRGBA(bounds)}
+}
+
+// add draws a frame onto the canvas, returns a copy of the resulting canvas,
+// and then disposes the frame.
+func (c *compositor) add(frame image.Image, rect image.Rectangle, op draw.Op, dispose disposal) *image.NRGBA {
+	var previous *image.NRGBA
+	if dispose == disposePrevious {
+		previous = cloneNRGBA(c.canvas)
+	}
+
+	draw.Draw(c.canvas, rect, frame, frame.Bounds().Min, op)
+	result := cloneNRGBA(c.canvas)
+
+	switch dispose {
+	case disposeBackground:
+		draw.Draw(c.canvas, rect, image.Transparent, image.Point{}, draw.Src)
+	case disposePrevious:
+		c.canvas = previous
+	}
+	return result
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	c := *img
+	c.Pix = append([]byte(nil), img.Pix...)
+	return &c
+}
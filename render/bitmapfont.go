@@ -0,0 +1,505 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// BitmapFont is a font.Face of a BDF or PCF bitmap font. It is rendered
+// pixel-exact, so it should only be scaled by integer factors.
+// Glyphs are looked up by their encoding, which is assumed to be Unicode
+// (i.e. ISO10646 or ISO8859-1 fonts).
+type BitmapFont struct {
+	glyphs       map[rune]*bitmapGlyph
+	defaultGlyph *bitmapGlyph
+	ascent       int
+	descent      int
+}
+
+type bitmapGlyph struct {
+	mask    *image.Alpha // bounds relative to the dot
+	advance int
+}
+
+// ReadBitmapFont reads a BDF or PCF font file, which may be gzip compressed.
+func ReadBitmapFont(path string) (*BitmapFont, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBitmapFont(data)
+}
+
+// ParseBitmapFont parses a BDF or PCF font, which may be gzip compressed.
+func ParseBitmapFont(data []byte) (*BitmapFont, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	var f *BitmapFont
+	var err error
+	switch {
+	case isBDF(data):
+		f, err = parseBDF(data)
+	case isPCF(data):
+		f, err = parsePCF(data)
+	default:
+		return nil, fmt.Errorf("not a BDF or PCF font")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.ascent+f.descent <= 0 {
+		return nil, fmt.Errorf("font has a height of %d pixels", f.ascent+f.descent)
+	}
+	return f, nil
+}
+
+func isBDF(data []byte) bool { return bytes.HasPrefix(data, []byte("STARTFONT")) }
+func isPCF(data []byte) bool { return bytes.HasPrefix(data, []byte(pcfMagic)) }
+
+// IsBitmapFace reports whether face is a bitmap font, which should only be
+// scaled by integer factors.
+func IsBitmapFace(face font.Face) bool {
+	switch face.(type) {
+	case *BitmapFont, *basicfont.Face:
+		return true
+	}
+	return false
+}
+
+func (f *BitmapFont) glyph(r rune) (*bitmapGlyph, bool) {
+	if g, ok := f.glyphs[r]; ok {
+		return g, true
+	}
+	return f.defaultGlyph, false
+}
+
+// Close implements font.Face
+func (f *BitmapFont) Close() error { return nil }
+
+// Glyph implements font.Face
+func (f *BitmapFont) Glyph(dot fixed.Point26_6, r rune) (dr image.Rectangle, mask image.Image, maskp image.Point, advance fixed.Int26_6, ok bool) {
+	g, ok := f.glyph(r)
+	if g == nil {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+	dr = g.mask.Bounds().Add(image.Pt(dot.X.Round(), dot.Y.Round()))
+	return dr, g.mask, g.mask.Bounds().Min, fixed.I(g.advance), ok
+}
+
+// GlyphBounds implements font.Face
+func (f *BitmapFont) GlyphBounds(r rune) (bounds fixed.Rectangle26_6, advance fixed.Int26_6, ok bool) {
+	g, ok := f.glyph(r)
+	if g == nil {
+		return fixed.Rectangle26_6{}, 0, false
+	}
+	b := g.mask.Bounds()
+	bounds = fixed.R(b.Min.X, b.Min.Y, b.Max.X, b.Max.Y)
+	return bounds, fixed.I(g.advance), ok
+}
+
+// GlyphAdvance implements font.Face
+func (f *BitmapFont) GlyphAdvance(r rune) (advance fixed.Int26_6, ok bool) {
+	g, ok := f.glyph(r)
+	if g == nil {
+		return 0, false
+	}
+	return fixed.I(g.advance), ok
+}
+
+// Kern implements font.Face
+func (f *BitmapFont) Kern(r0, r1 rune) fixed.Int26_6 { return 0 }
+
+// Metrics implements font.Face
+func (f *BitmapFont) Metrics() font.Metrics {
+	return font.Metrics{
+		Height:     fixed.I(f.ascent + f.descent),
+		Ascent:     fixed.I(f.ascent),
+		Descent:    fixed.I(f.descent),
+		XHeight:    fixed.I(f.ascent / 2),
+		CapHeight:  fixed.I(f.ascent),
+		CaretSlope: image.Pt(0, 1),
+	}
+}
+
+// glyphMask creates the mask of a glyph of size w×h from rows of MSB first
+// bits, each row being stride bytes long. (x, y) is the top left corner
+// relative to the dot.
+func glyphMask(bits []byte, stride, x, y, w, h int) (*image.Alpha, error) {
+	if w < 0 || h < 0 || len(bits) < stride*h || stride*8 < w {
+		return nil, fmt.Errorf("invalid glyph bitmap")
+	}
+	mask := image.NewAlpha(image.Rect(x, y, x+w, y+h))
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			if bits[row*stride+col/8]&(0x80>>uint(col%8)) != 0 {
+				mask.Pix[row*mask.Stride+col] = 0xff
+			}
+		}
+	}
+	return mask, nil
+}
+
+// parseBDF parses the Glyph Bitmap Distribution Format, see
+// https://www.adobe.com/content/dam/acom/en/devnet/font/pdfs/5005.BDF_Spec.pdf
+func parseBDF(data []byte) (*BitmapFont, error) {
+	f := &BitmapFont{glyphs: make(map[rune]*bitmapGlyph)}
+	var (
+		ascent, descent = -1, -1
+		fontBBX         [4]int
+		fontAdvance     int
+		defaultChar     = -1
+		g               *bitmapGlyph
+		encoding        int
+		bbx             [4]int
+		bitmap          []byte
+		inBitmap        bool
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		keyword, args := fields[0], fields[1:]
+		ints := func(n int) ([]int, error) {
+			if len(args) < n {
+				return nil, fmt.Errorf("line %d: %s needs %d values", lineNum, keyword, n)
+			}
+			v := make([]int, n)
+			for i := range v {
+				var err error
+				if v[i], err = strconv.Atoi(args[i]); err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNum, err)
+				}
+			}
+			return v, nil
+		}
+
+		if inBitmap {
+			if keyword != "ENDCHAR" {
+				row, err := hex.DecodeString(keyword)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid bitmap: %w", lineNum, err)
+				}
+				bitmap = append(bitmap, row...)
+				continue
+			}
+			inBitmap = false
+			stride := (bbx[0] + 7) / 8
+			// glyphs are positioned by the bottom left corner relative to the dot, y pointing up
+			mask, err := glyphMask(bitmap, stride, bbx[2], -(bbx[3] + bbx[1]), bbx[0], bbx[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			g.mask = mask
+			if encoding >= 0 {
+				f.glyphs[rune(encoding)] = g
+			}
+			g = nil
+			continue
+		}
+
+		var v []int
+		var err error
+		switch keyword {
+		case "FONTBOUNDINGBOX":
+			if v, err = ints(4); err == nil {
+				copy(fontBBX[:], v)
+			}
+		case "FONT_ASCENT":
+			if v, err = ints(1); err == nil {
+				ascent = v[0]
+			}
+		case "FONT_DESCENT":
+			if v, err = ints(1); err == nil {
+				descent = v[0]
+			}
+		case "DEFAULT_CHAR":
+			if v, err = ints(1); err == nil {
+				defaultChar = v[0]
+			}
+		case "DWIDTH":
+			if v, err = ints(1); err == nil {
+				if g != nil {
+					g.advance = v[0]
+				} else {
+					fontAdvance = v[0]
+				}
+			}
+		case "STARTCHAR":
+			g = &bitmapGlyph{advance: fontAdvance}
+			bbx = fontBBX
+			encoding = -1
+		case "ENCODING":
+			if v, err = ints(1); err == nil {
+				encoding = v[0]
+			}
+		case "BBX":
+			if v, err = ints(4); err == nil {
+				copy(bbx[:], v)
+			}
+		case "BITMAP":
+			if g == nil {
+				return nil, fmt.Errorf("line %d: BITMAP outside of glyph", lineNum)
+			}
+			inBitmap, bitmap = true, bitmap[:0]
+		case "ENDCHAR":
+			g = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if ascent < 0 || descent < 0 {
+		ascent, descent = fontBBX[1]+fontBBX[3], -fontBBX[3]
+	}
+	f.ascent, f.descent = ascent, descent
+	if defaultChar >= 0 {
+		f.defaultGlyph = f.glyphs[rune(defaultChar)]
+	}
+	if len(f.glyphs) == 0 {
+		return nil, fmt.Errorf("font contains no glyphs")
+	}
+	return f, nil
+}
+
+// PCF is the compiled format of X11 bitmap fonts, see
+// https://fontforge.org/docs/techref/pcf-format.html
+const pcfMagic = "\x01fcp"
+
+const (
+	pcfAccelerators    = 1 << 1
+	pcfMetrics         = 1 << 2
+	pcfBitmaps         = 1 << 3
+	pcfBDFEncodings    = 1 << 5
+	pcfBDFAccelerators = 1 << 8
+
+	pcfCompressedMetrics = 0x100
+	pcfByteMSBFirst      = 1 << 2
+	pcfBitMSBFirst       = 1 << 3
+)
+
+var errPCFTruncated = errors.New("invalid PCF font: truncated data")
+
+type pcfTable struct {
+	format uint32
+	data   []byte // starting after the format
+	order  binary.ByteOrder
+}
+
+// has reports whether n bytes starting at off are within the table
+func (t pcfTable) has(off, n int) bool { return off >= 0 && n >= 0 && off <= len(t.data)-n }
+
+func (t pcfTable) u16(off int) int { return int(t.order.Uint16(t.data[off:])) }
+func (t pcfTable) i16(off int) int { return int(int16(t.order.Uint16(t.data[off:]))) }
+func (t pcfTable) i32(off int) int { return int(int32(t.order.Uint32(t.data[off:]))) }
+
+type pcfMetric struct {
+	left, right, width, ascent, descent int
+}
+
+func parsePCF(data []byte) (*BitmapFont, error) {
+	if len(data) < 8 {
+		return nil, errPCFTruncated
+	}
+	tables := make(map[uint32]pcfTable)
+	numTables := binary.LittleEndian.Uint32(data[4:])
+	if uint64(numTables) > uint64(len(data)-8)/16 {
+		return nil, errPCFTruncated
+	}
+	for i := 0; i < int(numTables); i++ {
+		entry := data[8+16*i:]
+		typ := binary.LittleEndian.Uint32(entry)
+		size := binary.LittleEndian.Uint32(entry[8:])
+		offset := binary.LittleEndian.Uint32(entry[12:])
+		if size < 4 || uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, errPCFTruncated
+		}
+		tableData := data[offset : offset+size]
+		t := pcfTable{format: binary.LittleEndian.Uint32(tableData), data: tableData[4:], order: binary.LittleEndian}
+		if t.format&pcfByteMSBFirst != 0 {
+			t.order = binary.BigEndian
+		}
+		tables[typ] = t
+	}
+
+	metricsTable, ok1 := tables[pcfMetrics]
+	bitmapsTable, ok2 := tables[pcfBitmaps]
+	encodingsTable, ok3 := tables[pcfBDFEncodings]
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("invalid PCF font: missing tables")
+	}
+
+	metrics, err := parsePCFMetrics(metricsTable)
+	if err != nil {
+		return nil, err
+	}
+	glyphs, err := parsePCFBitmaps(bitmapsTable, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &BitmapFont{glyphs: make(map[rune]*bitmapGlyph)}
+	enc := encodingsTable
+	if !enc.has(0, 10) {
+		return nil, errPCFTruncated
+	}
+	minChar, maxChar := enc.i16(0), enc.i16(2)
+	minByte1, maxByte1 := enc.i16(4), enc.i16(6)
+	defaultChar := enc.i16(8)
+	cols := maxChar - minChar + 1
+	numCodes := cols * (maxByte1 - minByte1 + 1)
+	if cols <= 0 || numCodes <= 0 || !enc.has(10, 2*numCodes) {
+		return nil, errPCFTruncated
+	}
+	for i := 0; i < numCodes; i++ {
+		index := enc.u16(10 + 2*i)
+		if index == 0xffff || index >= len(glyphs) {
+			continue
+		}
+		code := (minByte1+i/cols)<<8 | (minChar + i%cols)
+		f.glyphs[rune(code)] = glyphs[index]
+	}
+	f.defaultGlyph = f.glyphs[rune(defaultChar)]
+
+	accel, ok := tables[pcfBDFAccelerators]
+	if !ok {
+		accel, ok = tables[pcfAccelerators]
+	}
+	if ok && !accel.has(8, 8) {
+		return nil, errPCFTruncated
+	}
+	if ok {
+		f.ascent, f.descent = accel.i32(8), accel.i32(12)
+	} else {
+		for _, m := range metrics {
+			if m.ascent > f.ascent {
+				f.ascent = m.ascent
+			}
+			if m.descent > f.descent {
+				f.descent = m.descent
+			}
+		}
+	}
+	if len(f.glyphs) == 0 {
+		return nil, fmt.Errorf("font contains no glyphs")
+	}
+	return f, nil
+}
+
+func parsePCFMetrics(t pcfTable) ([]pcfMetric, error) {
+	var metrics []pcfMetric
+	if t.format&pcfCompressedMetrics != 0 {
+		if !t.has(0, 2) {
+			return nil, errPCFTruncated
+		}
+		n := t.i16(0)
+		if !t.has(2, 5*n) {
+			return nil, errPCFTruncated
+		}
+		for i := 0; i < n; i++ {
+			d := t.data[2+5*i:]
+			metrics = append(metrics, pcfMetric{
+				int(d[0]) - 0x80, int(d[1]) - 0x80, int(d[2]) - 0x80, int(d[3]) - 0x80, int(d[4]) - 0x80,
+			})
+		}
+		return metrics, nil
+	}
+	if !t.has(0, 4) {
+		return nil, errPCFTruncated
+	}
+	n := t.i32(0)
+	if n > len(t.data)/12 || !t.has(4, 12*n) {
+		return nil, errPCFTruncated
+	}
+	for i := 0; i < n; i++ {
+		off := 4 + 12*i
+		metrics = append(metrics, pcfMetric{
+			t.i16(off), t.i16(off + 2), t.i16(off + 4), t.i16(off + 6), t.i16(off + 8),
+		})
+	}
+	return metrics, nil
+}
+
+func parsePCFBitmaps(t pcfTable, metrics []pcfMetric) ([]*bitmapGlyph, error) {
+	if !t.has(0, 4) {
+		return nil, errPCFTruncated
+	}
+	n := t.i32(0)
+	if n != len(metrics) {
+		return nil, fmt.Errorf("invalid PCF font: %d bitmaps for %d metrics", n, len(metrics))
+	}
+	// offsets of each glyph, followed by the sizes of the bitmaps for each padding
+	if !t.has(4, 4*n+16) {
+		return nil, errPCFTruncated
+	}
+	pad := 1 << (t.format & 3)
+	scanUnit := 1 << ((t.format >> 4) & 3)
+	size := t.i32(4 + 4*n + 4*int(t.format&3))
+	if !t.has(4+4*n+16, size) {
+		return nil, errPCFTruncated
+	}
+	bits := append([]byte(nil), t.data[4+4*n+16:][:size]...)
+
+	// normalize to MSB first bit & byte order
+	if t.format&pcfBitMSBFirst == 0 {
+		for i, b := range bits {
+			bits[i] = reverseBits(b)
+		}
+	}
+	if (t.format&pcfByteMSBFirst != 0) != (t.format&pcfBitMSBFirst != 0) && scanUnit > 1 {
+		for i := 0; i+scanUnit <= len(bits); i += scanUnit {
+			unit := bits[i : i+scanUnit]
+			for a, b := 0, len(unit)-1; a < b; a, b = a+1, b-1 {
+				unit[a], unit[b] = unit[b], unit[a]
+			}
+		}
+	}
+
+	glyphs := make([]*bitmapGlyph, n)
+	for i, m := range metrics {
+		w, h := m.right-m.left, m.ascent+m.descent
+		stride := ((w+7)/8 + pad - 1) / pad * pad
+		offset := t.i32(4 + 4*i)
+		if offset < 0 || offset > len(bits) {
+			return nil, errPCFTruncated
+		}
+		mask, err := glyphMask(bits[offset:], stride, m.left, -m.ascent, w, h)
+		if err != nil {
+			return nil, err
+		}
+		glyphs[i] = &bitmapGlyph{mask: mask, advance: m.width}
+	}
+	return glyphs, nil
+}
+
+func reverseBits(b byte) byte {
+	b = b>>4 | b<<4
+	b = (b&0xcc)>>2 | (b&0x33)<<2
+	return (b&0xaa)>>1 | (b&0x55)<<1
+}
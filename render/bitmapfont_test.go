@@ -0,0 +1,112 @@
+package render
+
+import (
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// testGlyphs are the glyphs of the fonts in testdata, rows of pixels starting at their top left corner
+var testGlyphs = map[rune]struct {
+	min     image.Point
+	advance int
+	rows    []string
+}{
+	'?': {image.Pt(0, -7), 6, []string{".###.", "#...#", "....#", "..##.", "..#..", ".....", "..#.."}},
+	'A': {image.Pt(0, -7), 6, []string{".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"}},
+	'g': {image.Pt(0, -5), 5, []string{".###", "#..#", "#..#", ".###", "...#", "###."}},
+}
+
+func glyphRows(mask image.Image, b image.Rectangle, maskp image.Point) []string {
+	rows := make([]string, b.Dy())
+	for y := range rows {
+		row := make([]byte, b.Dx())
+		for x := range row {
+			row[x] = '.'
+			if _, _, _, a := mask.At(maskp.X+x, maskp.Y+y).RGBA(); a != 0 {
+				row[x] = '#'
+			}
+		}
+		rows[y] = string(row)
+	}
+	return rows
+}
+
+func checkTestFont(t *testing.T, path string) {
+	t.Helper()
+	f, err := ReadBitmapFont(path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if m := f.Metrics(); m.Ascent != fixed.I(7) || m.Descent != fixed.I(1) || m.Height != fixed.I(8) {
+		t.Errorf("%s: unexpected metrics %+v", path, m)
+	}
+	for r, want := range testGlyphs {
+		dr, mask, maskp, advance, ok := f.Glyph(fixed.Point26_6{}, r)
+		if !ok {
+			t.Errorf("%s: glyph %q is missing", path, r)
+			continue
+		}
+		if dr.Min != want.min || advance != fixed.I(want.advance) {
+			t.Errorf("%s: glyph %q is at %v with advance %d, expected %v and %d", path, r, dr.Min, advance.Round(), want.min, want.advance)
+		}
+		if rows := glyphRows(mask, dr, maskp); !reflect.DeepEqual(rows, want.rows) {
+			t.Errorf("%s: glyph %q is\n%s\nexpected\n%s", path, r, strings.Join(rows, "\n"), strings.Join(want.rows, "\n"))
+		}
+	}
+	// missing glyphs are replaced by the default char
+	if _, _, _, _, ok := f.Glyph(fixed.Point26_6{}, 'x'); ok {
+		t.Errorf("%s: glyph 'x' is not missing", path)
+	}
+	_, advance, _ := f.GlyphBounds('x')
+	if advance != fixed.I(testGlyphs['?'].advance) {
+		t.Errorf("%s: missing glyph isn't replaced by the default char", path)
+	}
+}
+
+func TestParseBDF(t *testing.T) {
+	checkTestFont(t, "testdata/test.bdf")
+}
+
+func TestParsePCF(t *testing.T) {
+	// test-msb.pcf: big endian, 4 byte row padding. test-lsb.pcf: little
+	// endian with reversed bit order, 1 byte row padding, compressed metrics
+	checkTestFont(t, "testdata/test-msb.pcf")
+	checkTestFont(t, "testdata/test-lsb.pcf")
+}
+
+func TestParseBrokenPCF(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test-msb.pcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := ParseBitmapFont(data[:n]); err == nil && n > 0 {
+			t.Errorf("font truncated to %d bytes was accepted", n)
+		}
+	}
+	// counts, offsets & sizes out of range
+	for off := 4; off+4 <= len(data); off += 4 {
+		for _, v := range []uint32{0xffffffff, 0x7fffffff, 0x8000} {
+			broken := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint32(broken[off:], v)
+			ParseBitmapFont(broken) // must not panic
+		}
+	}
+}
+
+func TestRejectZeroHeightFont(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := strings.NewReplacer("FONT_ASCENT 7", "FONT_ASCENT 0", "FONT_DESCENT 1", "FONT_DESCENT 0").Replace(string(data))
+	if _, err := ParseBitmapFont([]byte(s)); err == nil {
+		t.Error("font without height was accepted")
+	}
+}
@@ -0,0 +1,538 @@
+package render
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Effect transforms an image. Effects don't modify their input, and may grow
+// the image beyond its bounds, including negative coordinates.
+type Effect interface {
+	Apply(img *image.NRGBA) *image.NRGBA
+	Name() string
+	String() string // in the syntax understood by ParseEffect
+}
+
+type effectType struct {
+	usage string
+	parse func(args []string) (Effect, error)
+	new   func() Effect // zero value for decoding
+}
+
+var effectTypes = map[string]effectType{
+	"rgbsplit":  {"[<distance>] | [white] [<x>,<y>:<color> ...]", parseRGBSplit, func() Effect { return &RGBSplit{} }},
+	"invert":    {"", func([]string) (Effect, error) { return &Invert{}, nil }, func() Effect { return &Invert{} }},
+	"grayscale": {"", func([]string) (Effect, error) { return &Grayscale{}, nil }, func() Effect { return &Grayscale{} }},
+	"outline":   {"[<width> [<color>]]", parseOutline, func() Effect { return &Outline{} }},
+	"shadow":    {"[<x>,<y> [<color>]]", parseShadow, func() Effect { return &Shadow{} }},
+	"pixelate":  {"[<size>]", parsePixelate, func() Effect { return &Pixelate{} }},
+	"quantize":  {"<colors>|<palette> [mediancut|octree] [none|floyd|atkinson|bayer]", parseQuantize, func() Effect { return &Quantize{} }},
+}
+
+// EffectNames returns the names of all effects, sorted alphabetically
+func EffectNames() []string {
+	names := make([]string, 0, len(effectTypes))
+	for name := range effectTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EffectUsage returns the parameters of the named effect, as accepted by ParseEffect
+func EffectUsage(name string) string {
+	return strings.TrimSpace(name + " " + effectTypes[name].usage)
+}
+
+// ParseEffect parses an effect from its name followed by space separated
+// parameters, e.g. `outline 2 ff0000`. Colors are given as hex RGB or RGBA.
+func ParseEffect(s string) (Effect, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no effect given")
+	}
+	name := strings.ToLower(fields[0])
+	t, ok := effectTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown effect '%s', expected one of %s", name, strings.Join(EffectNames(), ", "))
+	}
+	e, err := t.parse(fields[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w\nusage: %s", err, EffectUsage(name))
+	}
+	return e, nil
+}
+
+// FX is an ordered list of effects, applied one after another. It can be
+// encoded as JSON & gob, so it can be stored and sent along with tasks.
+type FX []Effect
+
+// Apply applies all effects to img. img is returned unchanged if there are no effects.
+func (fx FX) Apply(img *image.NRGBA) *image.NRGBA {
+	for _, e := range fx {
+		img = e.Apply(img)
+	}
+	return img
+}
+
+// Contains reports whether fx contains an effect of the given name
+func (fx FX) Contains(name string) bool {
+	for _, e := range fx {
+		if e.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (fx FX) String() string {
+	if len(fx) == 0 {
+		return "none"
+	}
+	s := make([]string, len(fx))
+	for i, e := range fx {
+		s[i] = e.String()
+	}
+	return strings.Join(s, " | ")
+}
+
+type effectJSON struct {
+	Effect string
+	Params json.RawMessage `json:",omitempty"`
+}
+
+// MarshalJSON encodes each effect along with its name
+func (fx FX) MarshalJSON() ([]byte, error) {
+	list := make([]effectJSON, len(fx))
+	for i, e := range fx {
+		params, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = effectJSON{e.Name(), params}
+	}
+	return json.Marshal(list)
+}
+
+// UnmarshalJSON decodes effects encoded by MarshalJSON
+func (fx *FX) UnmarshalJSON(data []byte) error {
+	var list []effectJSON
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if list == nil {
+		*fx = nil
+		return nil
+	}
+	*fx = make(FX, len(list))
+	for i, item := range list {
+		t, ok := effectTypes[item.Effect]
+		if !ok {
+			return fmt.Errorf("unknown effect '%s'", item.Effect)
+		}
+		e := t.new()
+		if len(item.Params) > 0 {
+			if err := json.Unmarshal(item.Params, e); err != nil {
+				return err
+			}
+		}
+		(*fx)[i] = e
+	}
+	return nil
+}
+
+// GobEncode allows sending FX via net/rpc, which can't handle interfaces
+// without registering them
+func (fx FX) GobEncode() ([]byte, error) { return fx.MarshalJSON() }
+
+// GobDecode decodes FX encoded by GobEncode
+func (fx *FX) GobDecode(data []byte) error { return fx.UnmarshalJSON(data) }
+
+// RGBSplit draws tinted copies of the image at offsets behind it
+type RGBSplit struct {
+	Layers []SplitLayer
+	// WhiteOnly copies only the white pixels of the image, in the color of
+	// each layer, as the RGB split did before effects were introduced
+	WhiteOnly bool `json:",omitempty"`
+}
+
+// SplitLayer is a copy of the image drawn by RGBSplit, with each pixel
+// multiplied by Color
+type SplitLayer struct {
+	Offset image.Point
+	Color  color.NRGBA
+}
+
+// NewRGBSplit creates a red, green & blue split of the white pixels at the given distance
+func NewRGBSplit(d int) *RGBSplit {
+	return &RGBSplit{WhiteOnly: true, Layers: []SplitLayer{
+		{image.Pt(-d, -d), color.NRGBA{0xff, 0, 0, 0xff}},
+		{image.Pt(d, 0), color.NRGBA{0, 0xff, 0, 0xff}},
+		{image.Pt(-d, d), color.NRGBA{0, 0, 0xff, 0xff}},
+	}}
+}
+
+func parseRGBSplit(args []string) (Effect, error) {
+	e := &RGBSplit{}
+	if len(args) > 0 && args[0] == "white" {
+		e.WhiteOnly, args = true, args[1:]
+	}
+	if len(args) == 0 {
+		return NewRGBSplit(10), nil
+	}
+	if len(args) == 1 && !strings.Contains(args[0], ":") {
+		d, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid distance '%s'", args[0])
+		}
+		return NewRGBSplit(d), nil
+	}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid layer '%s'", arg)
+		}
+		offset, err := parsePoint(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseHexColor(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		e.Layers = append(e.Layers, SplitLayer{offset, c})
+	}
+	return e, nil
+}
+
+func (e *RGBSplit) Name() string { return "rgbsplit" }
+
+func (e *RGBSplit) String() string {
+	s := e.Name()
+	if e.WhiteOnly {
+		s += " white"
+	}
+	for _, l := range e.Layers {
+		s += fmt.Sprintf(" %d,%d:%s", l.Offset.X, l.Offset.Y, formatHexColor(l.Color))
+	}
+	return s
+}
+
+func (e *RGBSplit) Apply(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	bounds := b
+	for _, l := range e.Layers {
+		bounds = bounds.Union(b.Add(l.Offset))
+	}
+	out := image.NewNRGBA(bounds)
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	for _, l := range e.Layers {
+		var layer *image.NRGBA
+		if e.WhiteOnly {
+			layer = ImgColorFilter(img, white, l.Color)
+		} else {
+			layer = mapPixels(img, func(c color.NRGBA) color.NRGBA {
+				return color.NRGBA{mul8(c.R, l.Color.R), mul8(c.G, l.Color.G), mul8(c.B, l.Color.B), mul8(c.A, l.Color.A)}
+			})
+		}
+		draw.Draw(out, b.Add(l.Offset), layer, b.Min, draw.Over)
+	}
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+// Invert inverts the colors of the image, keeping its alpha
+type Invert struct{}
+
+func (e *Invert) Name() string   { return "invert" }
+func (e *Invert) String() string { return e.Name() }
+
+func (e *Invert) Apply(img *image.NRGBA) *image.NRGBA {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{0xff - c.R, 0xff - c.G, 0xff - c.B, c.A}
+	})
+}
+
+// Grayscale converts the image to gray by luminance, keeping its alpha
+type Grayscale struct{}
+
+func (e *Grayscale) Name() string   { return "grayscale" }
+func (e *Grayscale) String() string { return e.Name() }
+
+func (e *Grayscale) Apply(img *image.NRGBA) *image.NRGBA {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		y := uint8((299*int(c.R) + 587*int(c.G) + 114*int(c.B) + 500) / 1000)
+		return color.NRGBA{y, y, y, c.A}
+	})
+}
+
+// Outline draws a border of Width px around the non transparent pixels
+type Outline struct {
+	Width int
+	Color color.NRGBA
+}
+
+func parseOutline(args []string) (Effect, error) {
+	e := &Outline{Width: 1, Color: color.NRGBA{A: 0xff}}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("too many parameters")
+	}
+	if len(args) > 0 {
+		w, err := strconv.Atoi(args[0])
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid width '%s'", args[0])
+		}
+		e.Width = w
+	}
+	if len(args) > 1 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return nil, err
+		}
+		e.Color = c
+	}
+	return e, nil
+}
+
+func (e *Outline) Name() string { return "outline" }
+func (e *Outline) String() string {
+	return fmt.Sprintf("%s %d %s", e.Name(), e.Width, formatHexColor(e.Color))
+}
+
+func (e *Outline) Apply(img *image.NRGBA) *image.NRGBA {
+	outline := dilate(alphaMask(img), e.Width)
+	out := image.NewNRGBA(outline.Bounds())
+	draw.DrawMask(out, out.Bounds(), image.NewUniform(e.Color), image.Point{}, outline, out.Bounds().Min, draw.Over)
+	draw.Draw(out, img.Bounds(), img, img.Bounds().Min, draw.Over)
+	return out
+}
+
+// Shadow draws a silhouette of the image at an offset behind it
+type Shadow struct {
+	Offset image.Point
+	Color  color.NRGBA
+}
+
+func parseShadow(args []string) (Effect, error) {
+	e := &Shadow{Offset: image.Pt(2, 2), Color: color.NRGBA{A: 0xff}}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("too many parameters")
+	}
+	if len(args) > 0 {
+		offset, err := parsePoint(args[0])
+		if err != nil {
+			return nil, err
+		}
+		e.Offset = offset
+	}
+	if len(args) > 1 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return nil, err
+		}
+		e.Color = c
+	}
+	return e, nil
+}
+
+func (e *Shadow) Name() string { return "shadow" }
+func (e *Shadow) String() string {
+	return fmt.Sprintf("%s %d,%d %s", e.Name(), e.Offset.X, e.Offset.Y, formatHexColor(e.Color))
+}
+
+func (e *Shadow) Apply(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	shadow := b.Add(e.Offset)
+	out := image.NewNRGBA(b.Union(shadow))
+	draw.DrawMask(out, shadow, image.NewUniform(e.Color), image.Point{}, alphaMask(img), b.Min, draw.Over)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+// Pixelate averages the colors of blocks of Size×Size px
+type Pixelate struct {
+	Size int
+}
+
+func parsePixelate(args []string) (Effect, error) {
+	e := &Pixelate{Size: 4}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("too many parameters")
+	}
+	if len(args) > 0 {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid size '%s'", args[0])
+		}
+		e.Size = size
+	}
+	return e, nil
+}
+
+func (e *Pixelate) Name() string   { return "pixelate" }
+func (e *Pixelate) String() string { return fmt.Sprintf("%s %d", e.Name(), e.Size) }
+
+func (e *Pixelate) Apply(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	size := e.Size
+	if size < 1 {
+		size = 1
+	}
+	for by := b.Min.Y; by < b.Max.Y; by += size {
+		for bx := b.Min.X; bx < b.Max.X; bx += size {
+			block := image.Rect(bx, by, bx+size, by+size).Intersect(b)
+			// average premultiplied colors, so transparent pixels don't darken the block
+			var r, g, bl, a, n int
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					c := img.NRGBAAt(x, y)
+					r += int(c.R) * int(c.A)
+					g += int(c.G) * int(c.A)
+					bl += int(c.B) * int(c.A)
+					a += int(c.A)
+					n++
+				}
+			}
+			avg := color.NRGBA{}
+			if a > 0 {
+				avg = color.NRGBA{uint8(r / a), uint8(g / a), uint8(bl / a), uint8(a / n)}
+			}
+			draw.Draw(out, block, image.NewUniform(avg), image.Point{}, draw.Src)
+		}
+	}
+	return out
+}
+
+// Quantize reduces the image to a palette, which is either given or generated
+// from each frame, optionally dithering the result.
+type Quantize struct {
+	Colors      int            // size of the generated palette, if Palette is empty
+	Method      QuantizeMethod // how the palette is generated
+	Palette     []color.NRGBA
+	PaletteName string // name of Palette, if it's one of Palettes
+	Dither      Dither
+}
+
+func parseQuantize(args []string) (Effect, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no colors or palette given")
+	}
+	e := &Quantize{}
+	if n, err := strconv.Atoi(args[0]); err == nil {
+		if n < 1 || n > 256 {
+			return nil, fmt.Errorf("number of colors must be within 1 and 256")
+		}
+		e.Colors = n
+	} else if pal, ok := Palettes[args[0]]; ok {
+		e.PaletteName = args[0]
+		for _, c := range pal {
+			e.Palette = append(e.Palette, color.NRGBAModel.Convert(c).(color.NRGBA))
+		}
+	} else {
+		for _, hex := range strings.Split(args[0], ",") {
+			c, err := parseHexColor(hex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid palette '%s', expected a name or comma separated colors", args[0])
+			}
+			e.Palette = append(e.Palette, c)
+		}
+	}
+	for _, arg := range args[1:] {
+		if m, err := NewQuantizeMethod(arg); err == nil {
+			e.Method = m
+		} else if d, err := NewDither(arg); err == nil {
+			e.Dither = d
+		} else {
+			return nil, fmt.Errorf("invalid method or dither '%s'", arg)
+		}
+	}
+	return e, nil
+}
+
+func (e *Quantize) Name() string { return "quantize" }
+
+func (e *Quantize) String() string {
+	pal := e.PaletteName
+	if pal == "" && len(e.Palette) == 0 {
+		return fmt.Sprintf("%s %d %s %s", e.Name(), e.Colors, e.Method, e.Dither)
+	} else if pal == "" {
+		colors := make([]string, len(e.Palette))
+		for i, c := range e.Palette {
+			colors[i] = formatHexColor(c)
+		}
+		pal = strings.Join(colors, ",")
+	}
+	return fmt.Sprintf("%s %s %s", e.Name(), pal, e.Dither)
+}
+
+func (e *Quantize) Apply(img *image.NRGBA) *image.NRGBA {
+	var pal color.Palette
+	for _, c := range e.Palette {
+		pal = append(pal, c)
+	}
+	if len(pal) == 0 {
+		pal = e.Method.Palette(img, e.Colors)
+	}
+	return QuantizeImage(img, pal, e.Dither)
+}
+
+// mapPixels returns a copy of img with fn applied to each pixel
+func mapPixels(img *image.NRGBA, fn func(color.NRGBA) color.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.SetNRGBA(x, y, fn(img.NRGBAAt(x, y)))
+		}
+	}
+	return out
+}
+
+// alphaMask returns the alpha channel of img
+func alphaMask(img *image.NRGBA) *image.Alpha {
+	b := img.Bounds()
+	mask := image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			mask.SetAlpha(x, y, color.Alpha{img.NRGBAAt(x, y).A})
+		}
+	}
+	return mask
+}
+
+func mul8(a, b uint8) uint8 { return uint8((int(a)*int(b) + 127) / 255) }
+
+func parsePoint(s string) (p image.Point, err error) {
+	if _, err = fmt.Sscanf(s, "%d,%d", &p.X, &p.Y); err != nil {
+		return p, fmt.Errorf("invalid offset '%s', expected <x>,<y>", s)
+	}
+	return p, nil
+}
+
+// parseHexColor parses RGB or RGBA hex colors, such as ff0000 or ff000080
+func parseHexColor(s string) (color.NRGBA, error) {
+	b, err := hex.DecodeString(s)
+	switch {
+	case err == nil && len(b) == 3:
+		return color.NRGBA{b[0], b[1], b[2], 0xff}, nil
+	case err == nil && len(b) == 4:
+		return color.NRGBA{b[0], b[1], b[2], b[3]}, nil
+	}
+	return color.NRGBA{}, fmt.Errorf("invalid color '%s', expected hex RGB or RGBA", s)
+}
+
+func formatHexColor(c color.NRGBA) string {
+	if c.A == 0xff {
+		return hex.EncodeToString([]byte{c.R, c.G, c.B})
+	}
+	return hex.EncodeToString([]byte{c.R, c.G, c.B, c.A})
+}
@@ -0,0 +1,99 @@
+package render
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/gofont/gosmallcaps"
+	"golang.org/x/image/font/opentype"
+)
+
+// BasicFont is the name of the builtin 7x13 bitmap font, which is used if no
+// other font is given. It has a fixed size.
+const BasicFont = "basic"
+
+// BundledFonts are TrueType fonts compiled into the binary, available by name
+var BundledFonts = map[string][]byte{
+	"goregular":   goregular.TTF,
+	"gobold":      gobold.TTF,
+	"goitalic":    goitalic.TTF,
+	"gomedium":    gomedium.TTF,
+	"gomono":      gomono.TTF,
+	"gomonobold":  gomonobold.TTF,
+	"gosmallcaps": gosmallcaps.TTF,
+}
+
+// FontNames returns the names of the builtin fonts, sorted alphabetically
+func FontNames() []string {
+	names := []string{BasicFont}
+	for name := range BundledFonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsBuiltinFont reports whether name refers to a builtin font, see FontNames
+func IsBuiltinFont(name string) bool {
+	_, ok := BundledFonts[strings.ToLower(name)]
+	return ok || name == BasicFont
+}
+
+// LoadFont returns a face of the given size in pixels for a font, which is
+// either the name of a builtin font (see FontNames), or the path of a TTF / OTF
+// file. For font collections, the first font is used.
+// BDF & PCF bitmap fonts are supported as well, but have a fixed size.
+func LoadFont(nameOrPath string, size float64) (font.Face, error) {
+	if nameOrPath == BasicFont {
+		return basicfont.Face7x13, nil
+	}
+	if data, ok := BundledFonts[strings.ToLower(nameOrPath)]; ok {
+		return NewFontFace(data, size)
+	}
+	data, err := ioutil.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	if f, err := ParseBitmapFont(data); err == nil {
+		return f, nil
+	} else if isBitmapFontFile(nameOrPath) {
+		return nil, err
+	}
+	return NewFontFace(data, size)
+}
+
+func isBitmapFontFile(path string) bool {
+	path = strings.TrimSuffix(strings.ToLower(path), ".gz")
+	return strings.HasSuffix(path, ".bdf") || strings.HasSuffix(path, ".pcf")
+}
+
+// NewFontFace parses a TTF / OTF font or font collection, and returns an
+// antialiased face of the given size in pixels.
+func NewFontFace(data []byte, size float64) (font.Face, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("font size must be positive")
+	}
+	coll, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid font: %w", err)
+	}
+	f, err := coll.Font(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid font: %w", err)
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72, // so size is in pixels
+		Hinting: font.HintingFull,
+	})
+}
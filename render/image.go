@@ -6,6 +6,7 @@ import (
 	_ "image/gif" // register gif, jpeg, png format handlers
 	_ "image/jpeg"
 	"image/png"
+	"io"
 	"math"
 	"os"
 
@@ -17,6 +18,12 @@ func ReadImage(path string) (*image.NRGBA, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer reader.Close()
+	return DecodeImage(reader)
+}
+
+// DecodeImage reads an image in any of the registered formats from reader
+func DecodeImage(reader io.Reader) (*image.NRGBA, error) {
 	img, _, err := image.Decode(reader)
 	if err != nil {
 		return nil, err
@@ -33,18 +40,7 @@ func WriteImage(path string, img image.Image) error {
 		f.Close()
 		return err
 	}
-	return nil
-}
-
-func imgToNRGBA(img image.Image) *image.NRGBA {
-	b := img.Bounds()
-	r := image.NewNRGBA(b)
-	for x := b.Min.X; x < b.Max.X; x++ {
-		for y := b.Min.Y; y < b.Max.Y; y++ {
-			r.Set(x, y, img.At(x, y))
-		}
-	}
-	return r
+	return f.Close()
 }
 
 // ImgColorFilter replaces `from` with `to` in `img`, and sets all other pixels
@@ -64,28 +60,28 @@ func ImgColorFilter(img *image.NRGBA, from, to color.NRGBA) *image.NRGBA {
 	return r
 }
 
+// ScaleImage scales img by the given factors. High quality scaling
+// interpolates in linear light, otherwise nearest neighbour is used, which
+// keeps hard edges. The result's bounds start at 0,0.
 func ScaleImage(img image.Image, factorX, factorY float64, highQuality bool) (scaled *image.NRGBA) {
 	b := img.Bounds()
-	newX := int(math.Ceil(factorX * float64(b.Max.X)))
-	newY := int(math.Ceil(factorY * float64(b.Max.Y)))
-	scaledBounds := image.Rect(0, 0, newX, newY)
-	scaledImg := image.NewNRGBA(scaledBounds)
-	scaler := draw.NearestNeighbor
-	if highQuality {
-		scaler = draw.CatmullRom
-	}
-	scaler.Scale(scaledImg, scaledBounds, img, b, draw.Src, nil)
-	return scaledImg
+	size := image.Pt(
+		int(math.Ceil(factorX*float64(b.Dx()))),
+		int(math.Ceil(factorY*float64(b.Dy()))),
+	)
+	return resizeImage(img, size, highQuality)
 }
 
-func RotateImage90(img *image.NRGBA) (rotated *image.NRGBA) {
-	b := img.Bounds()
-	rotated = image.NewNRGBA(image.Rect(0, 0, b.Max.Y, b.Max.X))
-	for x := b.Min.X; x < b.Max.X; x++ {
-		for y := b.Min.Y; y < b.Max.Y; y++ {
-			col := img.NRGBAAt(x, y)
-			rotated.SetNRGBA(b.Max.Y-y, x, col)
-		}
+// resizeImage scales img to exactly the given size, see ScaleImage
+func resizeImage(img image.Image, size image.Point, highQuality bool) *image.NRGBA {
+	if !highQuality {
+		out := image.NewNRGBA(image.Rectangle{Max: size})
+		draw.NearestNeighbor.Scale(out, out.Bounds(), img, img.Bounds(), draw.Src, nil)
+		return out
+	}
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		src = imgToNRGBA(img)
 	}
-	return
+	return toLinear(src).resample(size.X, size.Y, catmullRomKernel).toNRGBA()
 }
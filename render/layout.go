@@ -0,0 +1,139 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FitMode determines how FitImage scales an image into a box
+type FitMode uint8
+
+const (
+	Fit     FitMode = iota // as large as possible while fully visible, keeping the aspect ratio
+	Fill                   // cover the whole box keeping the aspect ratio, cropping the overflow
+	Stretch                // cover the whole box, ignoring the aspect ratio
+)
+
+func (m FitMode) String() string { return []string{"fit", "fill", "stretch"}[m] }
+
+// NewFitMode parses "fit", "fill" or "stretch"
+func NewFitMode(v string) (FitMode, error) {
+	switch v {
+	case "fit":
+		return Fit, nil
+	case "fill":
+		return Fill, nil
+	case "stretch":
+		return Stretch, nil
+	}
+	return Fit, fmt.Errorf("invalid fit mode '%s', expected fit, fill or stretch", v)
+}
+
+// FitImage scales img into a box of the given size according to mode. Images
+// filling the box are cropped around their center. The result's bounds start at 0,0.
+func FitImage(img image.Image, box image.Point, mode FitMode, highQuality bool) *image.NRGBA {
+	size := img.Bounds().Size()
+	if size.X == 0 || size.Y == 0 || box.X <= 0 || box.Y <= 0 {
+		return image.NewNRGBA(image.Rectangle{})
+	}
+	fx, fy := float64(box.X)/float64(size.X), float64(box.Y)/float64(size.Y)
+	switch mode {
+	case Fit:
+		f := math.Min(fx, fy)
+		fx, fy = f, f
+	case Fill:
+		f := math.Max(fx, fy)
+		fx, fy = f, f
+	}
+	// compute the target size directly, so float errors can't exceed the box
+	scaled := image.Pt(
+		int(math.Max(1, math.Round(fx*float64(size.X)))),
+		int(math.Max(1, math.Round(fy*float64(size.Y)))),
+	)
+	if mode != Fill {
+		scaled = image.Pt(minInt(scaled.X, box.X), minInt(scaled.Y, box.Y))
+	}
+	out := resizeImage(img, scaled, highQuality)
+	if mode == Fill {
+		crop := image.Rectangle{Max: box}.Add(scaled.Sub(box).Div(2))
+		out, _ = CropImage(out, crop)
+	}
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Anchor places content within a container, as fraction of the space left
+// by the content along each axis: 0,0 is the top left, 1,1 the bottom right.
+type Anchor struct {
+	X, Y float64
+}
+
+var anchorNames = map[string]Anchor{
+	"top-left":     {0, 0},
+	"top":          {0.5, 0},
+	"top-right":    {1, 0},
+	"left":         {0, 0.5},
+	"center":       {0.5, 0.5},
+	"right":        {1, 0.5},
+	"bottom-left":  {0, 1},
+	"bottom":       {0.5, 1},
+	"bottom-right": {1, 1},
+}
+
+// AnchorNames lists the named anchors
+var AnchorNames = []string{"top-left", "top", "top-right", "left", "center", "right", "bottom-left", "bottom", "bottom-right"}
+
+// ParseAnchor parses a named anchor such as "center" or "bottom-right", or
+// percentages "<x>%,<y>%". A single percentage applies to both axes.
+func ParseAnchor(s string) (Anchor, error) {
+	if a, ok := anchorNames[strings.ToLower(s)]; ok {
+		return a, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > 2 {
+		return Anchor{}, fmt.Errorf("invalid anchor '%s'", s)
+	}
+	var fractions []float64
+	for _, p := range parts {
+		if !strings.HasSuffix(p, "%") {
+			return Anchor{}, fmt.Errorf("invalid anchor '%s', expected one of %s or <x>%%,<y>%%", s, strings.Join(AnchorNames, ", "))
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+		if err != nil {
+			return Anchor{}, fmt.Errorf("invalid anchor percentage '%s'", p)
+		}
+		fractions = append(fractions, v/100)
+	}
+	if len(fractions) == 1 {
+		return Anchor{fractions[0], fractions[0]}, nil
+	}
+	return Anchor{fractions[0], fractions[1]}, nil
+}
+
+func (a Anchor) String() string {
+	for _, name := range AnchorNames {
+		if anchorNames[name] == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("%v%%,%v%%", a.X*100, a.Y*100)
+}
+
+// Offset returns the top left position of content of the given size,
+// anchored within the container
+func (a Anchor) Offset(container, size image.Point) image.Point {
+	free := container.Sub(size)
+	return image.Pt(
+		int(math.Round(a.X*float64(free.X))),
+		int(math.Round(a.Y*float64(free.Y))),
+	)
+}
@@ -0,0 +1,189 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Palettes are the named palettes, usable wherever a palette name is
+// accepted. They contain the PrideFlags and palettes added by LoadPalettes,
+// which is meant to be called on startup, before palettes are used.
+var Palettes = make(map[string]color.Palette)
+
+func init() {
+	for name, pal := range PrideFlags {
+		Palettes[name] = pal
+	}
+}
+
+// PaletteNames returns the names of all Palettes, sorted alphabetically
+func PaletteNames() []string {
+	names := make([]string, 0, len(Palettes))
+	for name := range Palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPalettes adds the palettes found in dir to Palettes, replacing builtin
+// palettes of the same name. Supported are GIMP palettes (`.gpl`), files with
+// a hex color per line (`.hex`), and JSON files (`.json`) containing either a
+// list of hex colors, or an object of named lists. Palettes are named after
+// their file, except for the named lists. Returns the names of the loaded palettes.
+func LoadPalettes(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]color.Palette)
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || (ext != ".gpl" && ext != ".hex" && ext != ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+		pals, err := parsePaletteFile(name, ext, data)
+		if err != nil {
+			return nil, fmt.Errorf("could not load palette %s: %w", f.Name(), err)
+		}
+		for name, pal := range pals {
+			if err := validatePaletteName(name); err != nil {
+				return nil, fmt.Errorf("could not load palette %s: %w", f.Name(), err)
+			}
+			if len(pal) == 0 {
+				return nil, fmt.Errorf("could not load palette %s: no colors in '%s'", f.Name(), name)
+			}
+			loaded[name] = pal
+		}
+	}
+
+	names := make([]string, 0, len(loaded))
+	for name, pal := range loaded {
+		Palettes[name] = pal
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func parsePaletteFile(name, ext string, data []byte) (map[string]color.Palette, error) {
+	var pal color.Palette
+	var err error
+	switch ext {
+	case ".gpl":
+		pal, err = parseGPL(bytes.NewReader(data))
+	case ".hex":
+		pal, err = parseHexPalette(bytes.NewReader(data))
+	case ".json":
+		return parseJSONPalettes(name, data)
+	}
+	return map[string]color.Palette{name: pal}, err
+}
+
+// validatePaletteName ensures name can be given as a single word to the REPL,
+// where `:` separates options of the palette
+func validatePaletteName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t:") {
+		return fmt.Errorf("invalid palette name '%s', must not contain spaces or ':'", name)
+	}
+	return nil
+}
+
+// parseGPL parses a GIMP palette, consisting of a header followed by a line
+// per color with decimal RGB values and an optional color name
+func parseGPL(r io.Reader) (color.Palette, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() || strings.TrimSpace(s.Text()) != "GIMP Palette" {
+		return nil, fmt.Errorf("missing 'GIMP Palette' header")
+	}
+	var pal color.Palette
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue // headers such as Name or Columns
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected R G B values", line+1)
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value '%s'", line+1, fields[i])
+			}
+			rgb[i] = uint8(v)
+		}
+		pal = append(pal, color.NRGBA{rgb[0], rgb[1], rgb[2], 0xff})
+	}
+	return pal, s.Err()
+}
+
+// parseHexPalette parses a hex RGB or RGBA color per line, with optional leading #
+func parseHexPalette(r io.Reader) (color.Palette, error) {
+	s := bufio.NewScanner(r)
+	var pal color.Palette
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		c, err := parseHexColor(strings.TrimPrefix(l, "#"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pal = append(pal, c)
+	}
+	return pal, s.Err()
+}
+
+// parseJSONPalettes parses a list of hex colors, named after the file, or an
+// object of named lists of hex colors
+func parseJSONPalettes(name string, data []byte) (map[string]color.Palette, error) {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		pal, err := parseHexList(list)
+		return map[string]color.Palette{name: pal}, err
+	}
+	var named map[string][]string
+	if err := json.Unmarshal(data, &named); err != nil {
+		return nil, fmt.Errorf("expected a list of hex colors, or an object of named lists")
+	}
+	pals := make(map[string]color.Palette, len(named))
+	for n, list := range named {
+		pal, err := parseHexList(list)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", n, err)
+		}
+		pals[strings.ToLower(n)] = pal
+	}
+	return pals, nil
+}
+
+func parseHexList(list []string) (pal color.Palette, err error) {
+	for _, hex := range list {
+		c, err := parseHexColor(strings.TrimPrefix(hex, "#"))
+		if err != nil {
+			return nil, err
+		}
+		pal = append(pal, c)
+	}
+	return pal, nil
+}
@@ -1,6 +1,7 @@
 package render
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 	"math"
@@ -28,10 +29,42 @@ func (p *Pattern) ToFixedImage(bounds image.Rectangle) *image.NRGBA {
 	return img
 }
 
+// StripeOrientation determines the direction of the stripes of a StripePattern
+type StripeOrientation uint8
+
+const (
+	Horizontal StripeOrientation = iota
+	Vertical
+	Diagonal // stripes rising from the bottom left to the top right
+	Chevron  // stripes forming a zigzag
+)
+
+func (o StripeOrientation) String() string {
+	return []string{"horizontal", "vertical", "diagonal", "chevron"}[o]
+}
+
+// NewStripeOrientation parses "horizontal", "vertical", "diagonal" or "chevron"
+func NewStripeOrientation(v string) (StripeOrientation, error) {
+	switch v {
+	case "horizontal", "h":
+		return Horizontal, nil
+	case "vertical", "v":
+		return Vertical, nil
+	case "diagonal", "d":
+		return Diagonal, nil
+	case "chevron", "c":
+		return Chevron, nil
+	}
+	return Horizontal, fmt.Errorf("invalid stripe orientation '%s', expected horizontal, vertical, diagonal or chevron", v)
+}
+
+// StripePattern repeats a stripe for each color of the palette.
 type StripePattern struct {
 	Pattern
-	Size    int
-	Palette color.Palette
+	Size        int // total size of all stripes, divided evenly unless Widths is set
+	Palette     color.Palette
+	Orientation StripeOrientation
+	Widths      []int // width in px of each stripe, repeated if shorter than Palette
 }
 
 func (c *StripePattern) At(x, y int) color.Color {
@@ -40,12 +73,63 @@ func (c *StripePattern) At(x, y int) color.Color {
 		return color.Transparent
 	}
 
-	pxPerStripe := c.Size / n
-	if pxPerStripe <= 0 {
-		pxPerStripe = 1
+	var pos int
+	switch c.Orientation {
+	case Horizontal:
+		pos = y
+	case Vertical:
+		pos = x
+	case Diagonal:
+		pos = x + y
+	case Chevron:
+		// offset each column by a triangle wave of x, with the period of the stripes
+		period := c.period()
+		t := floorMod(x, 2*period)
+		if t > period {
+			t = 2*period - t
+		}
+		pos = y + t
+	}
+	return c.Palette[c.stripeAt(floorMod(pos, c.period()))]
+}
+
+// period returns the width of all stripes
+func (c *StripePattern) period() (sum int) {
+	for i := range c.Palette {
+		sum += c.width(i)
+	}
+	return sum
+}
+
+// width returns the width of the i-th stripe, at least 1px
+func (c *StripePattern) width(i int) int {
+	w := c.Size / len(c.Palette)
+	if len(c.Widths) != 0 {
+		w = c.Widths[i%len(c.Widths)]
+	}
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// stripeAt returns the index of the stripe at pos within the period
+func (c *StripePattern) stripeAt(pos int) int {
+	for i := range c.Palette {
+		if pos -= c.width(i); pos < 0 {
+			return i
+		}
+	}
+	return len(c.Palette) - 1
+}
+
+// floorMod returns a modulo b in [0,b), also for negative a
+func floorMod(a, b int) int {
+	m := a % b
+	if m < 0 {
+		m += b
 	}
-	stripeIndex := y / pxPerStripe % n // FIXME: y - c.Size? -> negative modulo fix
-	return c.Palette[stripeIndex]
+	return m
 }
 
 func NewPrideImage(p color.Palette, bounds image.Rectangle) image.Image {
@@ -0,0 +1,455 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Dither determines how the error of colors reduced to a palette is spread
+type Dither uint8
+
+const (
+	DitherNone Dither = iota
+	FloydSteinberg
+	Atkinson
+	Bayer // ordered dithering with an 8x8 Bayer matrix
+)
+
+func (d Dither) String() string { return []string{"none", "floyd", "atkinson", "bayer"}[d] }
+
+// MarshalText encodes the dither in a human readable form, which is parsed by UnmarshalText
+func (d Dither) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+func (d *Dither) UnmarshalText(v []byte) (err error) {
+	*d, err = NewDither(string(v))
+	return err
+}
+
+// NewDither parses "none", "floyd", "atkinson" or "bayer"
+func NewDither(v string) (Dither, error) {
+	switch v {
+	case "none", "":
+		return DitherNone, nil
+	case "floyd", "floydsteinberg", "fs":
+		return FloydSteinberg, nil
+	case "atkinson":
+		return Atkinson, nil
+	case "bayer", "ordered":
+		return Bayer, nil
+	}
+	return DitherNone, fmt.Errorf("invalid dither '%s'", v)
+}
+
+// QuantizeMethod determines how a palette is generated from an image
+type QuantizeMethod uint8
+
+const (
+	MedianCut QuantizeMethod = iota
+	Octree
+)
+
+func (m QuantizeMethod) String() string { return []string{"mediancut", "octree"}[m] }
+
+// MarshalText encodes the method in a human readable form, which is parsed by UnmarshalText
+func (m QuantizeMethod) MarshalText() ([]byte, error) { return []byte(m.String()), nil }
+func (m *QuantizeMethod) UnmarshalText(v []byte) (err error) {
+	*m, err = NewQuantizeMethod(string(v))
+	return err
+}
+
+// NewQuantizeMethod parses "mediancut" or "octree"
+func NewQuantizeMethod(v string) (QuantizeMethod, error) {
+	switch v {
+	case "mediancut", "median", "":
+		return MedianCut, nil
+	case "octree":
+		return Octree, nil
+	}
+	return MedianCut, fmt.Errorf("invalid quantization method '%s'", v)
+}
+
+// Palette returns a palette of at most n colors representing the opaque pixels of img
+func (m QuantizeMethod) Palette(img *image.NRGBA, n int) color.Palette {
+	if m == Octree {
+		return OctreePalette(img, n)
+	}
+	return MedianCutPalette(img, n)
+}
+
+// QuantizeImage reduces the colors of img to those of pal, spreading the
+// error according to d. Alpha is kept, transparent pixels remain untouched.
+func QuantizeImage(img *image.NRGBA, pal color.Palette, d Dither) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	if len(pal) == 0 {
+		copy(out.Pix, img.Pix)
+		return out
+	}
+	m := newPaletteMatcher(pal)
+
+	switch d {
+	case FloydSteinberg:
+		diffuseError(img, out, m, floydSteinbergKernel)
+	case Atkinson:
+		diffuseError(img, out, m, atkinsonKernel)
+	default:
+		// spread of the ordered dither, roughly the distance between palette colors
+		spread := 0.0
+		if d == Bayer {
+			spread = 255 / math.Cbrt(float64(len(pal)))
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := img.NRGBAAt(x, y)
+				if c.A == 0 {
+					continue
+				}
+				t := (float64(bayerMatrix[y&7][x&7])+0.5)/64 - 0.5
+				r, g, bl := float64(c.R)+t*spread, float64(c.G)+t*spread, float64(c.B)+t*spread
+				q := m.nearest(clamp8(r), clamp8(g), clamp8(bl))
+				out.SetNRGBA(x, y, color.NRGBA{q.R, q.G, q.B, c.A})
+			}
+		}
+	}
+	return out
+}
+
+var bayerMatrix = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// errorWeight distributes a fraction of the error to the pixel at an offset
+type errorWeight struct {
+	dx, dy int
+	w      float64
+}
+
+var floydSteinbergKernel = []errorWeight{
+	{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16},
+}
+
+// atkinsonKernel only spreads 3/4 of the error, which keeps more contrast
+var atkinsonKernel = []errorWeight{
+	{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8},
+}
+
+// diffuseError quantizes img into out, spreading the error of each pixel to
+// its not yet visited neighbours. Errors aren't spread to transparent pixels.
+func diffuseError(img, out *image.NRGBA, m *paletteMatcher, kernel []errorWeight) {
+	b := img.Bounds()
+	w := b.Dx()
+	// rolling buffer of the rgb errors of the rows affected by the kernel
+	rows := 1
+	for _, k := range kernel {
+		if k.dy+1 > rows {
+			rows = k.dy + 1
+		}
+	}
+	errs := make([][]float64, rows)
+	for i := range errs {
+		errs[i] = make([]float64, 3*w)
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cur := errs[0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			i := 3 * (x - b.Min.X)
+			// the error is based on the clamped color, so it can't build up
+			// in regions the palette can't represent
+			r := clamp8(float64(c.R) + cur[i])
+			g := clamp8(float64(c.G) + cur[i+1])
+			bl := clamp8(float64(c.B) + cur[i+2])
+			q := m.nearest(r, g, bl)
+			out.SetNRGBA(x, y, color.NRGBA{q.R, q.G, q.B, c.A})
+
+			er, eg, eb := float64(int(r)-int(q.R)), float64(int(g)-int(q.G)), float64(int(bl)-int(q.B))
+			for _, k := range kernel {
+				nx := x - b.Min.X + k.dx
+				if nx < 0 || nx >= w || y+k.dy >= b.Max.Y || img.NRGBAAt(x+k.dx, y+k.dy).A == 0 {
+					continue
+				}
+				row := errs[k.dy]
+				row[3*nx] += er * k.w
+				row[3*nx+1] += eg * k.w
+				row[3*nx+2] += eb * k.w
+			}
+		}
+		// advance the buffer by one row, reusing the current one
+		copy(errs, errs[1:])
+		for i := range cur {
+			cur[i] = 0
+		}
+		errs[rows-1] = cur
+	}
+}
+
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	} else if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// paletteMatcher finds the nearest palette color, caching results
+type paletteMatcher struct {
+	pal   []color.NRGBA
+	cache map[uint32]color.NRGBA
+}
+
+func newPaletteMatcher(p color.Palette) *paletteMatcher {
+	m := &paletteMatcher{cache: make(map[uint32]color.NRGBA)}
+	for _, c := range p {
+		m.pal = append(m.pal, color.NRGBAModel.Convert(c).(color.NRGBA))
+	}
+	return m
+}
+
+func (m *paletteMatcher) nearest(r, g, b uint8) color.NRGBA {
+	key := uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+	if c, ok := m.cache[key]; ok {
+		return c
+	}
+	best, bestDist := m.pal[0], math.MaxInt32
+	for _, c := range m.pal {
+		dr, dg, db := int(c.R)-int(r), int(c.G)-int(g), int(c.B)-int(b)
+		// weighted by the sensitivity of the eye, roughly
+		if d := 3*dr*dr + 4*dg*dg + 2*db*db; d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	m.cache[key] = best
+	return best
+}
+
+// colorCount is a distinct color of an image, and how often it occurs
+type colorCount struct {
+	c     [3]uint8
+	count int
+}
+
+// histogram counts the distinct colors of the opaque pixels of img
+func histogram(img *image.NRGBA) []colorCount {
+	b := img.Bounds()
+	counts := make(map[uint32]int)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A != 0 {
+				counts[uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B)]++
+			}
+		}
+	}
+	hist := make([]colorCount, 0, len(counts))
+	for k, n := range counts {
+		hist = append(hist, colorCount{[3]uint8{uint8(k >> 16), uint8(k >> 8), uint8(k)}, n})
+	}
+	// map iteration is random, but the palette should be deterministic
+	sort.Slice(hist, func(i, j int) bool {
+		return hist[i].c[0] < hist[j].c[0] || hist[i].c[0] == hist[j].c[0] &&
+			(hist[i].c[1] < hist[j].c[1] || hist[i].c[1] == hist[j].c[1] && hist[i].c[2] < hist[j].c[2])
+	})
+	return hist
+}
+
+// average returns the mean color of the weighted colors
+func average(colors []colorCount) color.NRGBA {
+	var sum [3]int
+	n := 0
+	for _, c := range colors {
+		for i := range sum {
+			sum[i] += int(c.c[i]) * c.count
+		}
+		n += c.count
+	}
+	return color.NRGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 0xff}
+}
+
+// MedianCutPalette returns at most n colors representing the opaque pixels
+// of img, by recursively splitting the color space at the median of the
+// box with the widest channel range.
+func MedianCutPalette(img *image.NRGBA, n int) color.Palette {
+	hist := histogram(img)
+	if len(hist) == 0 || n < 1 {
+		return nil
+	}
+	boxes := [][]colorCount{hist}
+	for len(boxes) < n {
+		// find the box & channel with the largest range
+		split, channel, maxRange := -1, 0, 0
+		for i, box := range boxes {
+			for ch := 0; ch < 3; ch++ {
+				lo, hi := box[0].c[ch], box[0].c[ch]
+				for _, c := range box {
+					if c.c[ch] < lo {
+						lo = c.c[ch]
+					} else if c.c[ch] > hi {
+						hi = c.c[ch]
+					}
+				}
+				if r := int(hi - lo); r > maxRange {
+					split, channel, maxRange = i, ch, r
+				}
+			}
+		}
+		if split < 0 {
+			break // all boxes contain a single color
+		}
+
+		box := boxes[split]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].c[channel] < box[j].c[channel] })
+		total := 0
+		for _, c := range box {
+			total += c.count
+		}
+		// split at the pixel median, keeping at least one color in each half
+		median, acc := 1, 0
+		for i, c := range box[:len(box)-1] {
+			acc += c.count
+			median = i + 1
+			if acc >= total/2 {
+				break
+			}
+		}
+		boxes[split] = box[:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		pal[i] = average(box)
+	}
+	return pal
+}
+
+type octreeNode struct {
+	sum      [3]int
+	count    int
+	children [8]*octreeNode
+	leaf     bool
+}
+
+func (n *octreeNode) removeChild(child *octreeNode) {
+	for i, c := range n.children {
+		if c == child {
+			n.children[i] = nil
+		}
+	}
+}
+
+// OctreePalette returns at most n colors representing the opaque pixels of
+// img, by inserting all colors into an octree of depth 8, and merging the
+// least frequent deepest nodes until at most n leaves are left.
+func OctreePalette(img *image.NRGBA, n int) color.Palette {
+	hist := histogram(img)
+	if len(hist) == 0 || n < 1 {
+		return nil
+	}
+	const depth = 8
+	root := &octreeNode{}
+	var levels [depth][]*octreeNode // internal nodes by depth
+	levels[0] = []*octreeNode{root}
+	leaves := 0
+	for _, c := range hist {
+		node := root
+		for level := 0; level < depth; level++ {
+			shift := uint(7 - level)
+			i := (c.c[0]>>shift&1)<<2 | (c.c[1]>>shift&1)<<1 | c.c[2]>>shift&1
+			if node.children[i] == nil {
+				node.children[i] = &octreeNode{}
+				if level+1 < depth {
+					levels[level+1] = append(levels[level+1], node.children[i])
+				} else {
+					node.children[i].leaf = true
+					leaves++
+				}
+			}
+			node = node.children[i]
+		}
+		for ch := range node.sum {
+			node.sum[ch] += int(c.c[ch]) * c.count
+		}
+		node.count += c.count
+	}
+
+	// merge the children of the deepest internal nodes, least frequent first
+	for level := depth - 1; level >= 0 && leaves > n; level-- {
+		nodes := levels[level]
+		for _, node := range nodes {
+			for _, child := range node.children {
+				if child != nil {
+					node.count += child.count
+				}
+			}
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+		for _, node := range nodes {
+			if leaves <= n {
+				break
+			}
+			var children []*octreeNode
+			for _, child := range node.children {
+				if child != nil {
+					children = append(children, child)
+				}
+			}
+			if excess := leaves - n; len(children)-1 > excess {
+				// merging all children would leave fewer than n colors, so
+				// only merge the least frequent ones
+				sort.SliceStable(children, func(i, j int) bool { return children[i].count < children[j].count })
+				merged := children[0]
+				for _, child := range children[1 : excess+1] {
+					for ch := range merged.sum {
+						merged.sum[ch] += child.sum[ch]
+					}
+					merged.count += child.count
+					node.removeChild(child)
+				}
+				leaves -= excess
+				break
+			}
+			for i, child := range node.children {
+				if child != nil {
+					for ch := range node.sum {
+						node.sum[ch] += child.sum[ch]
+					}
+					node.children[i] = nil
+				}
+			}
+			node.leaf = true
+			leaves -= len(children) - 1
+		}
+	}
+
+	var pal color.Palette
+	var collect func(node *octreeNode)
+	collect = func(node *octreeNode) {
+		if node.leaf {
+			pal = append(pal, color.NRGBA{
+				uint8(node.sum[0] / node.count), uint8(node.sum[1] / node.count), uint8(node.sum[2] / node.count), 0xff,
+			})
+			return
+		}
+		for _, child := range node.children {
+			if child != nil {
+				collect(child)
+			}
+		}
+	}
+	collect(root)
+	return pal
+}
@@ -0,0 +1,286 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// Resampling blends neighbouring pixels. Blending sRGB values directly darkens
+// edges between bright and dark regions, so images are resampled in linear
+// light, with premultiplied alpha so transparent pixels don't bleed their color.
+
+var (
+	gammaOnce    sync.Once
+	srgbToLinear [256]float32 // sRGB value to linear light in [0,1]
+	linearToSRGB [65536]uint8 // linear light scaled to [0,65535] to sRGB value
+)
+
+func initGamma() {
+	gammaOnce.Do(func() {
+		for i := range srgbToLinear {
+			v := float64(i) / 255
+			if v <= 0.04045 {
+				v /= 12.92
+			} else {
+				v = math.Pow((v+0.055)/1.055, 2.4)
+			}
+			srgbToLinear[i] = float32(v)
+		}
+		for i := range linearToSRGB {
+			v := float64(i) / 65535
+			if v <= 0.0031308 {
+				v *= 12.92
+			} else {
+				v = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+			linearToSRGB[i] = uint8(math.Round(v * 255))
+		}
+	})
+}
+
+// linearImage holds premultiplied RGBA in linear light, 4 values per pixel
+type linearImage struct {
+	pix  []float32
+	w, h int
+}
+
+func toLinear(img *image.NRGBA) linearImage {
+	initGamma()
+	b := img.Bounds()
+	l := linearImage{make([]float32, 4*b.Dx()*b.Dy()), b.Dx(), b.Dy()}
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < 4*b.Dx(); x += 4 {
+			a := float32(row[x+3]) / 255
+			l.pix[i] = srgbToLinear[row[x]] * a
+			l.pix[i+1] = srgbToLinear[row[x+1]] * a
+			l.pix[i+2] = srgbToLinear[row[x+2]] * a
+			l.pix[i+3] = a
+			i += 4
+		}
+	}
+	return l
+}
+
+func (l linearImage) toNRGBA() *image.NRGBA {
+	initGamma()
+	img := image.NewNRGBA(image.Rect(0, 0, l.w, l.h))
+	for i := 0; i < len(l.pix); i += 4 {
+		a := l.pix[i+3]
+		if a <= 0 {
+			continue
+		} else if a > 1 {
+			a = 1
+		}
+		for c := 0; c < 3; c++ {
+			// kernels with negative lobes may overshoot, clamp to valid colors
+			v := l.pix[i+c] / a
+			if v < 0 {
+				v = 0
+			} else if v > 1 {
+				v = 1
+			}
+			img.Pix[i+c] = linearToSRGB[int(v*65535+0.5)]
+		}
+		img.Pix[i+3] = uint8(a*255 + 0.5)
+	}
+	return img
+}
+
+// toLinear64 converts img to premultiplied linear light with 16 bit
+// precision, for use with golang.org/x/image/draw.
+func toLinear64(img *image.NRGBA) *image.RGBA64 {
+	l := toLinear(img)
+	out := image.NewRGBA64(img.Bounds())
+	for i, v := range l.pix {
+		out.Pix[2*i] = uint8(uint16(v*65535+0.5) >> 8)
+		out.Pix[2*i+1] = uint8(uint16(v*65535 + 0.5))
+	}
+	return out
+}
+
+// fromLinear64 converts premultiplied linear light to sRGB
+func fromLinear64(img *image.RGBA64) *image.NRGBA {
+	b := img.Bounds()
+	l := linearImage{make([]float32, 4*b.Dx()*b.Dy()), b.Dx(), b.Dy()}
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < 8*b.Dx(); x += 2 {
+			l.pix[i] = float32(uint16(row[x])<<8|uint16(row[x+1])) / 65535
+			i++
+		}
+	}
+	out := l.toNRGBA()
+	out.Rect = out.Rect.Add(b.Min)
+	return out
+}
+
+// resampleKernel is a filter used for resampling, which is 0 beyond support
+type resampleKernel struct {
+	support float64
+	at      func(x float64) float64
+}
+
+var catmullRomKernel = resampleKernel{2, func(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return (1.5*x-2.5)*x*x + 1
+	}
+	return ((-0.5*x+2.5)*x-4)*x + 2
+}}
+
+// contribution lists the weights of the source pixels starting at start,
+// which are blended into a destination pixel
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+// contributions determines how the pixels of a row or column of length
+// srcLen are blended into one of length dstLen. When downscaling the kernel
+// is widened, so all source pixels contribute.
+func contributions(srcLen, dstLen int, k resampleKernel) []contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	filterScale := math.Max(scale, 1)
+	support := k.support * filterScale
+	cs := make([]contribution, dstLen)
+	for i := range cs {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		weights := make([]float32, 0, end-start+1)
+		var sum float64
+		for j := start; j <= end; j++ {
+			w := 0.0
+			if d := math.Abs(float64(j)-center) / filterScale; d < k.support {
+				w = k.at(d)
+			}
+			weights = append(weights, float32(w))
+			sum += w
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] /= float32(sum)
+			}
+		}
+		cs[i] = contribution{start, weights}
+	}
+	return cs
+}
+
+// resample scales l to the given size, first along x, then along y.
+// Pixels beyond the edges are treated like the nearest edge pixel.
+func (l linearImage) resample(w, h int, k resampleKernel) linearImage {
+	clampIndex := func(i, max int) int {
+		if i < 0 {
+			return 0
+		} else if i >= max {
+			return max - 1
+		}
+		return i
+	}
+
+	tmp := linearImage{make([]float32, 4*w*l.h), w, l.h}
+	cx := contributions(l.w, w, k)
+	for y := 0; y < l.h; y++ {
+		src := l.pix[4*y*l.w:]
+		dst := tmp.pix[4*y*w:]
+		for x, c := range cx {
+			var r, g, b, a float32
+			for j, weight := range c.weights {
+				i := 4 * clampIndex(c.start+j, l.w)
+				r += src[i] * weight
+				g += src[i+1] * weight
+				b += src[i+2] * weight
+				a += src[i+3] * weight
+			}
+			dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = r, g, b, a
+		}
+	}
+
+	out := linearImage{make([]float32, 4*w*h), w, h}
+	cy := contributions(l.h, h, k)
+	for y, c := range cy {
+		dst := out.pix[4*y*w : 4*(y+1)*w]
+		for j, weight := range c.weights {
+			src := tmp.pix[4*clampIndex(c.start+j, l.h)*w:]
+			for i := range dst {
+				dst[i] += src[i] * weight
+			}
+		}
+	}
+	return out
+}
+
+// imgToNRGBA converts any image to NRGBA, with fast paths for the types
+// returned by the decoders of the standard library
+func imgToNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	r := image.NewNRGBA(b)
+	switch src := img.(type) {
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			copy(r.Pix[r.PixOffset(b.Min.X, y):r.PixOffset(b.Max.X, y)], src.Pix[src.PixOffset(b.Min.X, y):])
+		}
+
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			s, d := src.Pix[src.PixOffset(b.Min.X, y):], r.Pix[r.PixOffset(b.Min.X, y):]
+			for x := 0; x < 4*b.Dx(); x += 4 {
+				a := uint32(s[x+3])
+				d[x+3] = s[x+3]
+				if a == 0xff {
+					copy(d[x:x+3], s[x:x+3])
+				} else if a != 0 {
+					d[x] = uint8((uint32(s[x])*0xff + a/2) / a)
+					d[x+1] = uint8((uint32(s[x+1])*0xff + a/2) / a)
+					d[x+2] = uint8((uint32(s[x+2])*0xff + a/2) / a)
+				}
+			}
+		}
+
+	case *image.YCbCr:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			d := r.Pix[r.PixOffset(b.Min.X, y):]
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi, ci := src.YOffset(x, y), src.COffset(x, y)
+				i := 4 * (x - b.Min.X)
+				d[i], d[i+1], d[i+2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				d[i+3] = 0xff
+			}
+		}
+
+	case *image.Paletted:
+		pal := make([]color.NRGBA, 256)
+		for i, c := range src.Palette {
+			pal[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			s, d := src.Pix[src.PixOffset(b.Min.X, y):], r.Pix[r.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				c := pal[s[x]]
+				d[4*x], d[4*x+1], d[4*x+2], d[4*x+3] = c.R, c.G, c.B, c.A
+			}
+		}
+
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			s, d := src.Pix[src.PixOffset(b.Min.X, y):], r.Pix[r.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				d[4*x], d[4*x+1], d[4*x+2], d[4*x+3] = s[x], s[x], s[x], 0xff
+			}
+		}
+
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r.Set(x, y, img.At(x, y))
+			}
+		}
+	}
+	return r
+}
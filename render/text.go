@@ -1,7 +1,10 @@
 package render
 
 import (
+	"fmt"
 	"image"
+	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/image/draw"
 	"golang.org/x/image/font"
@@ -9,34 +12,233 @@ import (
 	"golang.org/x/image/math/fixed"
 )
 
-func pt(p fixed.Point26_6) image.Point {
-	return image.Point{
-		X: int(p.X+32) >> 6,
-		Y: int(p.Y+32) >> 6,
+// TextAlign is the horizontal alignment of lines of text
+type TextAlign uint8
+
+const (
+	AlignLeft TextAlign = iota
+	AlignCenter
+	AlignRight
+)
+
+func (a TextAlign) String() string { return []string{"left", "center", "right"}[a] }
+
+// NewTextAlign parses "left", "center" or "right"
+func NewTextAlign(v string) (TextAlign, error) {
+	switch v {
+	case "left", "l":
+		return AlignLeft, nil
+	case "center", "c":
+		return AlignCenter, nil
+	case "right", "r":
+		return AlignRight, nil
 	}
+	return AlignLeft, fmt.Errorf("invalid alignment '%s'", v)
 }
 
-func RenderText(text string, scale float64, texture, bgTex image.Image) *image.NRGBA {
-	face := basicfont.Face7x13
-	stringBounds, _ := font.BoundString(face, text)
+// TextStyle determines the look & layout of text rendered by RenderText
+type TextStyle struct {
+	Face       font.Face   // nil for basicfont.Face7x13
+	Scale      float64     // nearest neighbour upscaling of the rendered text, as basicfont is quite small
+	Texture    image.Image // fill of the glyphs
+	Background image.Image // fill behind the text, may be nil
+
+	MaxWidth    int       // wrap lines at this width in px (before scaling), 0 disables wrapping
+	Align       TextAlign // alignment of the lines relative to each other
+	LineSpacing float64   // factor of the font's line height, 0 is treated as 1
 
-	b := image.Rectangle{pt(stringBounds.Min), pt(stringBounds.Max)}
-	img := image.NewNRGBA(b)
+	// Outline and shadow make the text readable on busy backgrounds
+	Outline    int         // width of an outline around the glyphs in px, 0 disables it
+	OutlineTex image.Image // fill of the outline, defaults to black
+	Shadow     image.Point // offset of a drop shadow in px, zero disables it
+	ShadowTex  image.Image // fill of the shadow, defaults to black
+}
 
-	if bgTex != nil {
-		draw.Draw(img, b, bgTex, image.Point{}, draw.Src)
+// DefaultTextStyle renders white basicfont text on transparent background
+func DefaultTextStyle() TextStyle {
+	return TextStyle{
+		Scale:      10,
+		Texture:    image.White,
+		Background: image.Transparent,
 	}
+}
+
+func (s TextStyle) String() string {
+	return fmt.Sprintf("scale %v	wrap %d	align %s	spacing %v	outline %d	shadow %v",
+		s.Scale, s.MaxWidth, s.Align, s.lineSpacing(), s.Outline, s.Shadow)
+}
 
-	d := font.Drawer{
-		Dst:  img,
-		Src:  texture,
-		Face: face,
+func (s TextStyle) lineSpacing() float64 {
+	if s.LineSpacing <= 0 {
+		return 1
 	}
-	d.DrawString(text)
+	return s.LineSpacing
+}
+
+// pixelBounds returns the smallest pixel rectangle containing the fixed point rectangle
+func pixelBounds(r fixed.Rectangle26_6) image.Rectangle {
+	return image.Rect(r.Min.X.Floor(), r.Min.Y.Floor(), r.Max.X.Ceil(), r.Max.Y.Ceil())
+}
+
+// RenderText renders text according to style. Lines are broken at '\n', and
+// wrapped at word boundaries if they exceed style.MaxWidth.
+func RenderText(text string, style TextStyle) *image.NRGBA {
+	face := style.Face
+	if face == nil {
+		face = basicfont.Face7x13
+	}
+	lines := wrapText(face, text, style.MaxWidth)
+
+	// position the baseline of each line, and determine the bounds of all glyphs
+	lineHeight := fixed.Int26_6(float64(face.Metrics().Height) * style.lineSpacing())
+	var blockWidth fixed.Int26_6
+	for _, l := range lines {
+		if w := font.MeasureString(face, l); w > blockWidth {
+			blockWidth = w
+		}
+	}
+	dots := make([]fixed.Point26_6, len(lines))
+	var bounds image.Rectangle
+	for i, l := range lines {
+		dots[i].Y = face.Metrics().Ascent + fixed.Int26_6(i)*lineHeight
+		switch style.Align {
+		case AlignCenter:
+			dots[i].X = (blockWidth - font.MeasureString(face, l)) / 2
+		case AlignRight:
+			dots[i].X = blockWidth - font.MeasureString(face, l)
+		}
+		b, _ := font.BoundString(face, l)
+		b = b.Add(dots[i])
+		bounds = bounds.Union(pixelBounds(b))
+	}
+
+	// rasterize the glyphs into a mask, so they can be drawn in multiple layers
+	mask := image.NewAlpha(bounds)
+	d := font.Drawer{Dst: mask, Src: image.Opaque, Face: face}
+	for i, l := range lines {
+		d.Dot = dots[i]
+		d.DrawString(l)
+	}
+
+	var outline *image.Alpha
+	if style.Outline > 0 {
+		outline = dilate(mask, style.Outline)
+		bounds = outline.Bounds()
+	}
+	if style.Shadow != (image.Point{}) {
+		bounds = bounds.Union(bounds.Add(style.Shadow))
+	}
+
+	img := image.NewNRGBA(bounds)
+	if style.Background != nil {
+		draw.Draw(img, bounds, style.Background, bounds.Min, draw.Src)
+	}
+	if style.Shadow != (image.Point{}) {
+		shadowMask := mask
+		if outline != nil {
+			shadowMask = outline
+		}
+		r := shadowMask.Bounds().Add(style.Shadow)
+		draw.DrawMask(img, r, texOrBlack(style.ShadowTex), r.Min, shadowMask, shadowMask.Bounds().Min, draw.Over)
+	}
+	if outline != nil {
+		draw.DrawMask(img, outline.Bounds(), texOrBlack(style.OutlineTex), outline.Bounds().Min, outline, outline.Bounds().Min, draw.Over)
+	}
+	texture := style.Texture
+	if texture == nil {
+		texture = image.White
+	}
+	draw.DrawMask(img, mask.Bounds(), texture, mask.Bounds().Min, mask, mask.Bounds().Min, draw.Over)
 
 	// normalize bounds to start at 0,0
 	img.Rect = img.Bounds().Sub(img.Bounds().Min)
 
-	// scale up, as this font is quite small
-	return ScaleImage(img, scale, scale, false)
+	if style.Scale <= 0 || style.Scale == 1 {
+		return img
+	}
+	return ScaleImage(img, style.Scale, style.Scale, false)
+}
+
+func texOrBlack(tex image.Image) image.Image {
+	if tex == nil {
+		return image.Black
+	}
+	return tex
+}
+
+// wrapText splits text into lines at '\n', and wraps lines wider than
+// maxWidth at spaces. Words wider than maxWidth are broken up.
+func wrapText(face font.Face, text string, maxWidth int) (lines []string) {
+	width := fixed.I(maxWidth)
+	for _, paragraph := range strings.Split(text, "\n") {
+		if maxWidth <= 0 || font.MeasureString(face, paragraph) <= width {
+			lines = append(lines, paragraph)
+			continue
+		}
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if font.MeasureString(face, candidate) <= width {
+				line = candidate
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			// break up words that don't fit on a line by themselves
+			for font.MeasureString(face, word) > width {
+				n := fittingPrefix(face, word, width)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// fittingPrefix returns the length in bytes of the longest prefix of s that
+// fits into width, but at least one rune.
+func fittingPrefix(face font.Face, s string, width fixed.Int26_6) (n int) {
+	for i, r := range s {
+		end := i + utf8.RuneLen(r)
+		if n > 0 && font.MeasureString(face, s[:end]) > width {
+			break
+		}
+		n = end
+	}
+	return n
+}
+
+// dilate grows the opaque regions of mask by radius px in each direction
+func dilate(mask *image.Alpha, radius int) *image.Alpha {
+	b := mask.Bounds()
+	out := image.NewAlpha(b.Inset(-radius))
+	var offsets []image.Point
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= radius*radius {
+				offsets = append(offsets, image.Pt(dx, dy))
+			}
+		}
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := mask.AlphaAt(x, y).A
+			if a == 0 {
+				continue
+			}
+			for _, o := range offsets {
+				i := out.PixOffset(x+o.X, y+o.Y)
+				if out.Pix[i] < a {
+					out.Pix[i] = a
+				}
+			}
+		}
+	}
+	return out
 }
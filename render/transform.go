@@ -0,0 +1,157 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// Interpolation determines how pixels are sampled by transforms
+type Interpolation uint8
+
+const (
+	Nearest Interpolation = iota
+	Bilinear
+	Bicubic
+)
+
+func (i Interpolation) String() string { return []string{"nearest", "bilinear", "bicubic"}[i] }
+
+// NewInterpolation parses "nearest", "bilinear" or "bicubic"
+func NewInterpolation(v string) (Interpolation, error) {
+	switch v {
+	case "nearest", "n":
+		return Nearest, nil
+	case "bilinear", "linear", "l":
+		return Bilinear, nil
+	case "bicubic", "cubic", "c":
+		return Bicubic, nil
+	}
+	return Nearest, fmt.Errorf("invalid interpolation '%s'", v)
+}
+
+func (i Interpolation) interpolator() draw.Interpolator {
+	switch i {
+	case Bilinear:
+		return draw.BiLinear
+	case Bicubic:
+		return draw.CatmullRom
+	}
+	return draw.NearestNeighbor
+}
+
+// TransformImage applies the affine transformation m to img. The result is
+// large enough to contain the whole transformed image, and its bounds start at 0,0.
+func TransformImage(img *image.NRGBA, m f64.Aff3, interp Interpolation) *image.NRGBA {
+	b := img.Bounds()
+	// determine the bounds of the transformed corners
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range [][2]float64{
+		{float64(b.Min.X), float64(b.Min.Y)}, {float64(b.Max.X), float64(b.Min.Y)},
+		{float64(b.Min.X), float64(b.Max.Y)}, {float64(b.Max.X), float64(b.Max.Y)},
+	} {
+		x := m[0]*p[0] + m[1]*p[1] + m[2]
+		y := m[3]*p[0] + m[4]*p[1] + m[5]
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	// round away tiny float errors, so exact transforms don't grow by a pixel
+	const eps = 1e-6
+	minX, minY = math.Floor(minX+eps), math.Floor(minY+eps)
+	bounds := image.Rect(0, 0, int(math.Ceil(maxX-eps-minX)), int(math.Ceil(maxY-eps-minY)))
+
+	// translate the result to start at 0,0
+	m[2] -= minX
+	m[5] -= minY
+	if interp == Nearest {
+		out := image.NewNRGBA(bounds)
+		draw.NearestNeighbor.Transform(out, m, img, b, draw.Src, nil)
+		return out
+	}
+	// interpolate in linear light, see resample.go
+	linear := image.NewRGBA64(bounds)
+	interp.interpolator().Transform(linear, m, toLinear64(img), b, draw.Src, nil)
+	return fromLinear64(linear)
+}
+
+// RotateImage rotates img clockwise by deg degrees around its center. The
+// result grows to contain the whole rotated image. Multiples of 90° are
+// rotated losslessly.
+func RotateImage(img *image.NRGBA, deg float64, interp Interpolation) *image.NRGBA {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	if math.Mod(deg, 90) == 0 {
+		for ; deg > 0; deg -= 90 {
+			img = RotateImage90(img)
+		}
+		return normalizeBounds(img)
+	}
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	return TransformImage(img, f64.Aff3{cos, -sin, 0, sin, cos, 0}, interp)
+}
+
+// RotateImage90 rotates img clockwise by 90°. The result's bounds start at 0,0.
+func RotateImage90(img *image.NRGBA) (rotated *image.NRGBA) {
+	b := img.Bounds()
+	rotated = image.NewNRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for x := b.Min.X; x < b.Max.X; x++ {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			rotated.SetNRGBA(b.Max.Y-1-y, x-b.Min.X, img.NRGBAAt(x, y))
+		}
+	}
+	return
+}
+
+// FlipImage mirrors img horizontally (left to right) or vertically. The
+// result's bounds start at 0,0.
+func FlipImage(img *image.NRGBA, horizontal bool) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			sx, sy := b.Min.X+x, b.Min.Y+y
+			if horizontal {
+				sx = b.Max.X - 1 - x
+			} else {
+				sy = b.Max.Y - 1 - y
+			}
+			out.SetNRGBA(x, y, img.NRGBAAt(sx, sy))
+		}
+	}
+	return out
+}
+
+// ShearImage shears img by the factors sx along the x axis, and sy along the
+// y axis. A factor of 1 shifts a row (column) by 1px for each row (column).
+func ShearImage(img *image.NRGBA, sx, sy float64, interp Interpolation) *image.NRGBA {
+	return TransformImage(img, f64.Aff3{1, sx, 0, sy, 1, 0}, interp)
+}
+
+// CropImage returns a copy of the part of img within r, which is relative to
+// the top left corner of img. The result's bounds start at 0,0.
+func CropImage(img *image.NRGBA, r image.Rectangle) (*image.NRGBA, error) {
+	b := img.Bounds()
+	r = r.Add(b.Min).Intersect(b)
+	if r.Empty() {
+		return nil, fmt.Errorf("crop area is outside of the image %v", b.Size())
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Bounds(), img, r.Min, draw.Src)
+	return out, nil
+}
+
+// normalizeBounds moves the bounds of img to start at 0,0, sharing the pixels
+func normalizeBounds(img *image.NRGBA) *image.NRGBA {
+	if img.Rect.Min == (image.Point{}) {
+		return img
+	}
+	out := *img
+	out.Rect = img.Rect.Sub(img.Rect.Min)
+	return &out
+}
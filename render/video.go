@@ -0,0 +1,211 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const y4mSignature = "YUV4MPEG2 "
+
+// Video is a stream of uncompressed frames, read via ReadFrame
+type Video struct {
+	Size       image.Point
+	FrameDelay time.Duration // time between frames, according to the frame rate
+
+	r         *bufio.Reader
+	readFrame func() (*image.NRGBA, error)
+
+	// YUV4MPEG2 format parameters
+	chroma    image.Point // subsampling divisor of the chroma planes
+	mono      bool
+	alpha     bool
+	fullRange bool
+	planes    []byte
+}
+
+// NewVideo reads a YUV4MPEG2 stream from r. If the stream has no YUV4MPEG2
+// header, it is read as raw RGBA frames of the given size and frame rate,
+// which then must be specified.
+func NewVideo(r io.Reader, rawSize image.Point, rawFPS float64) (*Video, error) {
+	v := &Video{r: bufio.NewReaderSize(r, 1<<16)}
+	magic, err := v.r.Peek(len(y4mSignature))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) == y4mSignature {
+		return v, v.readY4MHeader()
+	}
+
+	if rawSize.X <= 0 || rawSize.Y <= 0 {
+		return nil, fmt.Errorf("not a YUV4MPEG2 stream, raw RGBA frames require a frame size")
+	}
+	if rawFPS <= 0 {
+		return nil, fmt.Errorf("raw RGBA frames require a frame rate")
+	}
+	v.Size = rawSize
+	v.FrameDelay = time.Duration(float64(time.Second) / rawFPS)
+	v.readFrame = v.readRGBAFrame
+	return v, nil
+}
+
+// ReadFrame returns the next frame. Returns io.EOF at the end of the stream.
+func (v *Video) ReadFrame() (*image.NRGBA, error) {
+	img, err := v.readFrame()
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF // ignore a truncated last frame
+	}
+	return img, err
+}
+
+func (v *Video) readRGBAFrame() (*image.NRGBA, error) {
+	img := image.NewNRGBA(image.Rectangle{Max: v.Size})
+	if _, err := io.ReadFull(v.r, img.Pix); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// readY4MHeader parses the stream header, see https://wiki.multimedia.cx/index.php/YUV4MPEG2
+func (v *Video) readY4MHeader() error {
+	header, err := v.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("invalid YUV4MPEG2 header: %w", err)
+	}
+	v.FrameDelay = time.Second / 25
+	v.chroma = image.Pt(2, 2) // 4:2:0 is the default
+
+	for _, param := range strings.Fields(strings.TrimPrefix(header, y4mSignature)) {
+		val := param[1:]
+		switch param[0] {
+		case 'W':
+			v.Size.X, err = strconv.Atoi(val)
+		case 'H':
+			v.Size.Y, err = strconv.Atoi(val)
+		case 'F':
+			var num, den int
+			if _, err = fmt.Sscanf(val, "%d:%d", &num, &den); err == nil && num > 0 && den > 0 {
+				v.FrameDelay = time.Duration(int64(time.Second) * int64(den) / int64(num))
+			}
+		case 'I':
+			if val != "p" && val != "?" {
+				return fmt.Errorf("interlaced YUV4MPEG2 streams are not supported")
+			}
+		case 'C':
+			err = v.setColorspace(val)
+		case 'X':
+			if strings.EqualFold(val, "COLORRANGE=FULL") {
+				v.fullRange = true
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid YUV4MPEG2 parameter '%s': %w", param, err)
+		}
+	}
+	if v.Size.X <= 0 || v.Size.Y <= 0 {
+		return fmt.Errorf("YUV4MPEG2 header lacks the frame size")
+	}
+
+	lumaSize := v.Size.X * v.Size.Y
+	planesSize := lumaSize
+	if !v.mono {
+		planesSize += 2 * v.chromaSize().X * v.chromaSize().Y
+	}
+	if v.alpha {
+		planesSize += lumaSize
+	}
+	v.planes = make([]byte, planesSize)
+	v.readFrame = v.readY4MFrame
+	return nil
+}
+
+func (v *Video) setColorspace(c string) error {
+	switch c {
+	case "420", "420jpeg", "420paldv", "420mpeg2":
+		v.chroma = image.Pt(2, 2)
+	case "422":
+		v.chroma = image.Pt(2, 1)
+	case "444":
+		v.chroma = image.Pt(1, 1)
+	case "444alpha":
+		v.chroma = image.Pt(1, 1)
+		v.alpha = true
+	case "mono":
+		v.mono = true
+	default:
+		return fmt.Errorf("unsupported colorspace")
+	}
+	return nil
+}
+
+func (v *Video) chromaSize() image.Point {
+	return image.Pt(
+		(v.Size.X+v.chroma.X-1)/v.chroma.X,
+		(v.Size.Y+v.chroma.Y-1)/v.chroma.Y,
+	)
+}
+
+func (v *Video) readY4MFrame() (*image.NRGBA, error) {
+	header, err := v.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if !bytes.HasPrefix(header, []byte("FRAME")) {
+		return nil, fmt.Errorf("invalid YUV4MPEG2 frame header")
+	}
+	if _, err := io.ReadFull(v.r, v.planes); err != nil {
+		return nil, err
+	}
+
+	w, h := v.Size.X, v.Size.Y
+	cs := v.chromaSize()
+	luma := v.planes[:w*h]
+	var cb, cr, alpha []byte
+	if !v.mono {
+		cb = v.planes[w*h : w*h+cs.X*cs.Y]
+		cr = v.planes[w*h+cs.X*cs.Y : w*h+2*cs.X*cs.Y]
+	}
+	if v.alpha {
+		alpha = v.planes[len(v.planes)-w*h:]
+	}
+
+	img := image.NewNRGBA(image.Rectangle{Max: v.Size})
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			Y, Cb, Cr := luma[y*w+x], uint8(128), uint8(128)
+			if !v.mono {
+				ci := (y/v.chroma.Y)*cs.X + x/v.chroma.X
+				Cb, Cr = cb[ci], cr[ci]
+			}
+			if !v.fullRange {
+				Y, Cb, Cr = expandRange(Y, 16, 235), expandRange(Cb, 16, 240), expandRange(Cr, 16, 240)
+			}
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = color.YCbCrToRGB(Y, Cb, Cr)
+			img.Pix[i+3] = 0xff
+			if alpha != nil {
+				img.Pix[i+3] = alpha[y*w+x]
+			}
+		}
+	}
+	return img, nil
+}
+
+// expandRange maps a value of the limited (TV) range [lo, hi] to [0, 255]
+func expandRange(v, lo, hi uint8) uint8 {
+	if v <= lo {
+		return 0
+	} else if v >= hi {
+		return 255
+	}
+	return uint8((int(v-lo)*255 + int(hi-lo)/2) / int(hi-lo))
+}
@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	callTimeout     = 5 * time.Second
+	transferTimeout = 60 * time.Second // sending images may take a while on slow links
+)
+
+var errTimeout = errors.New("rpc call timed out")
+
+// ránClient is a connected Hevring, along with its last heartbeat.
+// Tasks are delivered by a dedicated goroutine per client, so that slow clients
+// don't block others. Only the most recently enqueued operation is delivered.
+type ránClient struct {
+	*rpc.Client
+	id   string
+	addr string
+
+	mu       sync.Mutex
+	status   FlutStatus
+	lastSeen time.Time
+	pending  func()
+	notify   chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newRánClient(conn net.Conn, id string) *ránClient {
+	c := &ránClient{
+		Client:   rpc.NewClient(conn),
+		id:       id,
+		addr:     conn.RemoteAddr().String(),
+		lastSeen: time.Now(),
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+// call invokes the remote method, giving up after timeout
+func (c *ránClient) call(method string, args, reply interface{}, timeout time.Duration) error {
+	return timedCall(c.Client, method, args, reply, timeout)
+}
+
+// timedCall invokes the remote method, giving up after timeout
+func timedCall(c *rpc.Client, method string, args, reply interface{}, timeout time.Duration) error {
+	call := c.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+// enqueue schedules op for delivery to the client, replacing any op that
+// wasn't delivered yet.
+func (c *ránClient) enqueue(op func()) {
+	c.mu.Lock()
+	c.pending = op
+	c.mu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default: // a delivery is already scheduled
+	}
+}
+
+func (c *ránClient) deliver() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.notify:
+		}
+		c.mu.Lock()
+		op := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+		if op != nil {
+			op()
+		}
+	}
+}
+
+// getStatus returns the status of the last heartbeat, and when it was received
+func (c *ránClient) getStatus() (FlutStatus, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status, c.lastSeen
+}
+
+func (c *ránClient) beat(hb Heartbeat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = hb.FlutStatus
+	c.lastSeen = time.Now()
+}
+
+func (c *ránClient) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.Close()
+	})
+}
+
+// clientManager tracks the connected Hevrings. It is safe for concurrent use.
+type clientManager struct {
+	mu      sync.RWMutex
+	clients []*ránClient
+}
+
+// add registers a client and returns the number of clients
+func (m *clientManager) add(c *ránClient) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients = append(m.clients, c)
+	return len(m.clients)
+}
+
+// remove unregisters & closes a client, and returns the number of remaining
+// clients. Returns -1 if the client was removed already.
+func (m *clientManager) remove(c *ránClient) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.close()
+	for i, client := range m.clients {
+		if client == c {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			return len(m.clients)
+		}
+	}
+	return -1
+}
+
+// get returns the client with the given id, or nil
+func (m *clientManager) get(id string) *ránClient {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, c := range m.clients {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// list returns a snapshot of all clients
+func (m *clientManager) list() []*ránClient {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*ránClient(nil), m.clients...)
+}
+
+// broadcast calls fn for all clients in parallel, and returns once all calls completed.
+func (m *clientManager) broadcast(fn func(c *ránClient)) {
+	wg := sync.WaitGroup{}
+	for _, c := range m.list() {
+		wg.Add(1)
+		go func(c *ránClient) {
+			defer wg.Done()
+			fn(c)
+		}(c)
+	}
+	wg.Wait()
+}
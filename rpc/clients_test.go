@@ -0,0 +1,273 @@
+package rpc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+// fakeRunner records the tasks a Hevring receives, taking delay for each
+type fakeRunner struct {
+	delay time.Duration
+
+	mu    sync.Mutex
+	task  pixelflut.FlutTask
+	runs  int
+	stops int
+	busy  bool
+}
+
+func (f *fakeRunner) run(t pixelflut.FlutTask) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.task, f.busy = t, true
+	f.runs++
+}
+
+func (f *fakeRunner) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.busy = false
+	f.stops++
+}
+
+func (f *fakeRunner) fluting() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.busy
+}
+
+func (f *fakeRunner) lastTask() pixelflut.FlutTask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.task
+}
+
+func (f *fakeRunner) performance() pixelflut.Performance { return pixelflut.Performance{Conns: 1} }
+func (f *fakeRunner) setMetrics(enabled bool)            {}
+
+// newTestRán starts a Rán on loopback, without reading commands from stdin
+func newTestRán(t *testing.T) (*Rán, string) {
+	r := &Rán{images: newImgCache(imgCacheSize)}
+	r.repl = NewREPL(r)
+	r.repl.console = newSession("", ioutil.Discard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.handleConn(conn)
+		}
+	}()
+	go r.watchHeartbeats()
+	return r, l.Addr().String()
+}
+
+// testImage returns an image distinct for each i
+func testImage(i int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for p := range img.Pix {
+		img.Pix[p] = 0xff
+	}
+	img.Pix[0], img.Pix[1] = uint8(i), uint8(i>>8)
+	return img
+}
+
+func TestClientsDontBlockREPL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for rpc & heartbeat timeouts")
+	}
+	r, addr := newTestRán(t)
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	connect := func(runner *fakeRunner, stop chan bool) {
+		h := newHevring(runner, stop, &wg)
+		if _, err := h.greet(addr, stop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var fast []*fakeRunner
+	for i := 0; i < 3; i++ {
+		runner := &fakeRunner{}
+		connect(runner, stop)
+		fast = append(fast, runner)
+	}
+	// takes longer than callTimeout to accept a task
+	connect(&fakeRunner{delay: callTimeout + time.Second}, stop)
+
+	// dead client: says hello, but neither serves RPCs nor sends heartbeats
+	dead, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	if err := writeHello(dead, connCtrl, newHevringID()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var bg sync.WaitGroup
+
+	// clients come and go
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		for {
+			quit := make(chan bool)
+			connect(&fakeRunner{}, quit)
+			select {
+			case <-done:
+				close(quit)
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			close(quit)
+		}
+	}()
+
+	// the dashboard polls the client status
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		for {
+			for _, c := range r.clients.list() {
+				c.getStatus()
+			}
+			r.getMetrics()
+			r.getEvents()
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	// tasks are applied & stopped via the REPL, which must stay responsive
+	task := pixelflut.FlutTask{FlutTaskOpts: pixelflut.FlutTaskOpts{Address: "127.0.0.1:1", MaxConns: 1}}
+	session := newSession("test", ioutil.Discard)
+	var slowest time.Duration
+	deadline := time.Now().Add(heartbeatTimeout + callTimeout)
+	for i := 0; time.Now().Before(deadline); i++ {
+		start := time.Now()
+		switch i % 3 {
+		case 0:
+			task.Img = testImage(i)
+			r.ApplyTask(task)
+		case 1:
+			r.repl.exec(session, "stop")
+		case 2:
+			r.repl.exec(session, "start")
+		}
+		if d := time.Since(start); d > slowest {
+			slowest = d
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(done)
+	bg.Wait()
+	if slowest > callTimeout/5 {
+		t.Errorf("REPL was blocked for %v", slowest)
+	}
+
+	final := testImage(-1)
+	task.Img = final
+	r.ApplyTask(task)
+	waitFor(t, 2*callTimeout, func() error {
+		for i, runner := range fast {
+			if img := runner.lastTask().Img; img == nil || imgHash(img) != imgHash(final) {
+				return fmt.Errorf("client %d didn't receive the latest task", i)
+			}
+		}
+		return nil
+	})
+
+	// the dead client missed its heartbeats and is dropped, the others stay
+	waitFor(t, 2*heartbeatTimeout, func() error {
+		if n := len(r.clients.list()); n != len(fast)+1 {
+			return fmt.Errorf("%d clients connected, expected %d", n, len(fast)+1)
+		}
+		return nil
+	})
+}
+
+// dialBeat opens a heartbeat connection for id, sending heartbeats until it is closed
+func dialBeat(t *testing.T, addr, id string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHello(conn, connBeat, id); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		enc := gob.NewEncoder(conn)
+		for seq := 0; enc.Encode(Heartbeat{Seq: seq}) == nil; seq++ {
+			time.Sleep(heartbeatInterval / 5)
+		}
+	}()
+	return conn
+}
+
+// expectClosed fails the test if conn isn't closed by the other side within timeout
+func expectClosed(t *testing.T, conn net.Conn, timeout time.Duration, what string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		t.Errorf("%s was not closed within %v", what, timeout)
+	}
+}
+
+func TestHeartbeatConnsClosed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the hello timeout")
+	}
+	r, addr := newTestRán(t)
+
+	unpaired := dialBeat(t, addr, newHevringID())
+	defer unpaired.Close()
+
+	id := newHevringID()
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	if err := writeHello(ctrl, connCtrl, id); err != nil {
+		t.Fatal(err)
+	}
+	beat := dialBeat(t, addr, id)
+	defer beat.Close()
+
+	var client *ránClient
+	waitFor(t, time.Second, func() error {
+		if client = r.clients.get(id); client == nil {
+			return fmt.Errorf("client didn't connect")
+		}
+		return nil
+	})
+	time.Sleep(heartbeatInterval) // let the heartbeats pair with the client
+	r.clients.remove(client)
+	expectClosed(t, beat, time.Second, "heartbeat connection of dropped client")
+
+	expectClosed(t, unpaired, helloTimeout+heartbeatInterval, "unpaired heartbeat connection")
+}
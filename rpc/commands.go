@@ -0,0 +1,411 @@
+package rpc
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+// ArgType determines how an argument of a Command is parsed
+type ArgType int
+
+const (
+	ArgString   ArgType = iota // a single word
+	ArgInt                     // an integer
+	ArgFloat                   // a floating point number
+	ArgDuration                // a duration as understood by time.ParseDuration
+	ArgColor                   // a hex color or palette name, see parseColorOrPalette
+	ArgText                    // all remaining input, including spaces. Must be the last argument
+)
+
+// Arg describes an argument of a Command
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool                      // optional args must follow the required ones
+	Choices  []string                  // if set, only these values are accepted
+	Validate func(v interface{}) error // called with the parsed value, if set
+	Complete func() []string           // suggests values in addition to Choices, if set
+}
+
+// Command is a REPL command, registered via REPL.Register
+type Command struct {
+	Name    string
+	Aliases []string
+	Group   string // section of the help text
+	Args    []Arg
+	Usage   string // overrides the usage of the args generated from Args, if set
+	Help    string
+
+	// Subs are subcommands, selected by the first argument. If it doesn't
+	// match a subcommand, the command itself is run.
+	Subs []*Command
+
+	// Task marks commands modifying Context.Task. The modified task is printed
+	// & applied, if Run returns no error.
+	Task bool
+
+	Run func(ctx *Context) error
+
+	path string // name including parent commands
+}
+
+// Context is passed to a running Command
+type Context struct {
+	Fluter Fluter
+	Task   pixelflut.FlutTask // the current task
+	Out    io.Writer          // broadcast to all operators
+
+	session  *session
+	args     map[string]interface{}
+	keepTask bool // don't apply the task, even though the command modifies it
+}
+
+// Has reports whether the optional argument of the given name was given
+func (c *Context) Has(name string) bool {
+	_, ok := c.args[name]
+	return ok
+}
+
+// Str returns the argument of the given name of type ArgString or ArgText
+func (c *Context) Str(name string) string {
+	v, _ := c.args[name].(string)
+	return v
+}
+
+// Int returns the argument of the given name of type ArgInt
+func (c *Context) Int(name string) int {
+	v, _ := c.args[name].(int)
+	return v
+}
+
+// Float returns the argument of the given name of type ArgFloat
+func (c *Context) Float(name string) float64 {
+	v, _ := c.args[name].(float64)
+	return v
+}
+
+// Duration returns the argument of the given name of type ArgDuration
+func (c *Context) Duration(name string) time.Duration {
+	v, _ := c.args[name].(time.Duration)
+	return v
+}
+
+// Color returns the argument of the given name of type ArgColor
+func (c *Context) Color(name string) image.Image {
+	v, _ := c.args[name].(image.Image)
+	return v
+}
+
+// Register adds a command to the REPL, replacing any command of the same name.
+func (r *REPL) Register(cmd *Command) {
+	r.cmdMu.Lock()
+	defer r.cmdMu.Unlock()
+	setPath(cmd, "")
+	for i, c := range r.commands {
+		if c.Name == cmd.Name {
+			r.commands[i] = cmd
+			return
+		}
+	}
+	r.commands = append(r.commands, cmd)
+}
+
+func setPath(cmd *Command, parent string) {
+	cmd.path = strings.TrimSpace(parent + " " + cmd.Name)
+	for _, sub := range cmd.Subs {
+		setPath(sub, cmd.path)
+	}
+}
+
+// lookup finds the command with the given name or alias
+func (r *REPL) lookup(name string) *Command {
+	r.cmdMu.RLock()
+	defer r.cmdMu.RUnlock()
+	return findCommand(r.commands, name)
+}
+
+func findCommand(cmds []*Command, name string) *Command {
+	name = strings.ToLower(name)
+	for _, c := range cmds {
+		if c.Name == name {
+			return c
+		}
+		for _, a := range c.Aliases {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// resolve finds the command for the given input, descending into subcommands.
+// Returns the unparsed remainder of the input.
+func (r *REPL) resolve(input string) (cmd *Command, rest string) {
+	name, rest := nextField(input)
+	if cmd = r.lookup(name); cmd == nil {
+		return nil, rest
+	}
+	for len(cmd.Subs) > 0 {
+		name, subRest := nextField(rest)
+		sub := findCommand(cmd.Subs, name)
+		if sub == nil {
+			break
+		}
+		cmd, rest = sub, subRest
+	}
+	return cmd, rest
+}
+
+// nextField splits off the first space separated word of s
+func nextField(s string) (field, rest string) {
+	s = strings.TrimLeft(s, " \t")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// parseArgs parses the input according to the args of cmd
+func (cmd *Command) parseArgs(input string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	rest := input
+	for _, a := range cmd.Args {
+		var word string
+		if a.Type == ArgText {
+			word, rest = strings.TrimLeft(rest, " \t"), ""
+		} else {
+			word, rest = nextField(rest)
+		}
+		if word == "" {
+			if a.Optional {
+				break
+			}
+			return nil, fmt.Errorf("missing argument <%s>", a.Name)
+		}
+		v, err := a.parse(word)
+		if err != nil {
+			return nil, err
+		}
+		args[a.Name] = v
+	}
+	if extra := strings.TrimSpace(rest); extra != "" {
+		return nil, fmt.Errorf("unexpected argument '%s'", extra)
+	}
+	return args, nil
+}
+
+func (a Arg) parse(word string) (v interface{}, err error) {
+	if len(a.Choices) > 0 && !contains(a.Choices, strings.ToLower(word)) {
+		return nil, fmt.Errorf("invalid <%s> '%s', expected one of %s", a.Name, word, strings.Join(a.Choices, ", "))
+	}
+
+	switch a.Type {
+	case ArgString, ArgText:
+		v = word
+	case ArgInt:
+		if v, err = strconv.Atoi(word); err != nil {
+			return nil, fmt.Errorf("invalid <%s> '%s', expected integer", a.Name, word)
+		}
+	case ArgFloat:
+		if v, err = strconv.ParseFloat(word, 64); err != nil {
+			return nil, fmt.Errorf("invalid <%s> '%s', expected number", a.Name, word)
+		}
+	case ArgDuration:
+		if v, err = time.ParseDuration(word); err != nil {
+			return nil, fmt.Errorf("invalid <%s> '%s', expected duration such as 1m30s", a.Name, word)
+		}
+	case ArgColor:
+		if v, err = parseColorOrPalette(word); err != nil {
+			return nil, fmt.Errorf("invalid <%s>: %w", a.Name, err)
+		}
+	}
+
+	if a.Validate != nil {
+		if err := a.Validate(v); err != nil {
+			return nil, fmt.Errorf("invalid <%s> '%s': %w", a.Name, word, err)
+		}
+	}
+	return v, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// positive validates ArgInt & ArgFloat args
+func positive(v interface{}) error {
+	switch n := v.(type) {
+	case int:
+		if n > 0 {
+			return nil
+		}
+	case float64:
+		if n > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be positive")
+}
+
+// nonNegative validates ArgInt & ArgFloat args
+func nonNegative(v interface{}) error {
+	switch n := v.(type) {
+	case int:
+		if n >= 0 {
+			return nil
+		}
+	case float64:
+		if n >= 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("must not be negative")
+}
+
+// usage returns the invocation of the command, e.g. `offset|of <x> <y>`
+func (cmd *Command) usage() string {
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	u := strings.TrimSuffix(cmd.path, cmd.Name) + strings.Join(names, "|")
+	if cmd.Usage != "" {
+		return u + " " + cmd.Usage
+	}
+	for _, a := range cmd.Args {
+		s := "<" + a.Name + ">"
+		if len(a.Choices) == 1 {
+			s = a.Choices[0]
+		}
+		if a.Optional {
+			s = "[" + s + "]"
+		}
+		u += " " + s
+	}
+	return u
+}
+
+// printHelp prints the usage of all commands, grouped into sections
+func (r *REPL) printHelp(w io.Writer) {
+	r.cmdMu.RLock()
+	defer r.cmdMu.RUnlock()
+
+	var groups []string
+	byGroup := make(map[string][]*Command)
+	for _, c := range r.commands {
+		if _, ok := byGroup[c.Group]; !ok {
+			groups = append(groups, c.Group)
+		}
+		byGroup[c.Group] = append(byGroup[c.Group], c)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.TabIndent)
+	fmt.Fprintln(tw, "available commands:")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "\t%s\n", g)
+		for _, c := range byGroup[g] {
+			printUsage(tw, c)
+		}
+	}
+	tw.Flush()
+}
+
+func printUsage(w io.Writer, cmd *Command) {
+	if cmd.Run != nil {
+		fmt.Fprintf(w, "\t\t%s\t%s\n", cmd.usage(), cmd.Help)
+	}
+	for _, sub := range cmd.Subs {
+		printUsage(w, sub)
+	}
+}
+
+// printCommandHelp prints the usage of a single command, including its arguments
+func (r *REPL) printCommandHelp(w io.Writer, name string) error {
+	cmd, _ := r.resolve(name)
+	if cmd == nil {
+		return fmt.Errorf("unknown command '%s'", name)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.TabIndent)
+	printUsage(tw, cmd)
+	for _, a := range cmd.Args {
+		if len(a.Choices) > 1 {
+			fmt.Fprintf(tw, "\t\t\t<%s>: %s\n", a.Name, strings.Join(a.Choices, ", "))
+		}
+	}
+	return tw.Flush()
+}
+
+// Complete returns completions of a partially entered command line, such as
+// command names or argument choices. Each completion is the full line.
+func (r *REPL) Complete(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasSuffix(line, " ") {
+		fields = append(fields, "") // complete a new word
+	}
+	partial := fields[len(fields)-1]
+	prefix := line[:len(line)-len(partial)]
+
+	var candidates []string
+	if len(fields) == 1 {
+		r.cmdMu.RLock()
+		for _, c := range r.commands {
+			candidates = append(candidates, c.Name)
+			candidates = append(candidates, c.Aliases...)
+		}
+		r.cmdMu.RUnlock()
+	} else {
+		cmd, rest := r.resolve(prefix)
+		if cmd == nil {
+			return nil
+		}
+		argIndex := len(strings.Fields(rest))
+		if argIndex == 0 {
+			for _, sub := range cmd.Subs {
+				candidates = append(candidates, sub.Name)
+			}
+		}
+		if argIndex < len(cmd.Args) {
+			candidates = append(candidates, cmd.Args[argIndex].suggestions()...)
+		} else if n := len(cmd.Args); n > 0 && cmd.Args[n-1].Type == ArgText && argIndex == n {
+			candidates = append(candidates, cmd.Args[n-1].suggestions()...)
+		}
+	}
+
+	var completions []string
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, partial) && !seen[c] {
+			seen[c] = true
+			completions = append(completions, prefix+c)
+		}
+	}
+	sort.Strings(completions)
+	return completions
+}
+
+func (a Arg) suggestions() []string {
+	s := append([]string(nil), a.Choices...)
+	if a.Type == ArgColor {
+		s = append(s, "w", "b", "t")
+		s = append(s, render.PaletteNames()...)
+		for name := range render.DynPatterns {
+			s = append(s, name)
+		}
+	}
+	if a.Complete != nil {
+		s = append(s, a.Complete()...)
+	}
+	return s
+}
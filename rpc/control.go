@@ -0,0 +1,227 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// operators that don't accept output for this long are disconnected
+	operatorWriteTimeout = 5 * time.Second
+	// bytes of output queued for an operator, before it is disconnected
+	operatorQueueSize = 1 << 20
+)
+
+// broadcaster is an io.Writer that duplicates all writes to a changing set of writers.
+// Writers failing to write are removed.
+type broadcaster struct {
+	mu      sync.Mutex
+	writers map[io.Writer]struct{}
+}
+
+func newBroadcaster(writers ...io.Writer) *broadcaster {
+	b := &broadcaster{writers: make(map[io.Writer]struct{})}
+	for _, w := range writers {
+		b.add(w)
+	}
+	return b
+}
+
+func (b *broadcaster) add(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writers[w] = struct{}{}
+}
+
+func (b *broadcaster) remove(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.writers, w)
+}
+
+func (b *broadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for w := range b.writers {
+		if _, err := w.Write(p); err != nil {
+			delete(b.writers, w)
+		}
+	}
+	return len(p), nil
+}
+
+// queuedWriter passes writes to w in the background, so writing never blocks.
+// If w falls behind by more than operatorQueueSize bytes or fails, the
+// queuedWriter is closed, closing w as well.
+type queuedWriter struct {
+	w       io.WriteCloser
+	mu      sync.Mutex
+	queue   []byte
+	pending chan struct{} // signals that the queue isn't empty
+	closed  bool
+}
+
+func newQueuedWriter(w io.WriteCloser) *queuedWriter {
+	q := &queuedWriter{w: w, pending: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+
+func (q *queuedWriter) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(q.queue)+len(p) > operatorQueueSize {
+		q.closeLocked()
+		return 0, fmt.Errorf("output queue full")
+	}
+	q.queue = append(q.queue, p...)
+	q.signal()
+	return len(p), nil
+}
+
+// Close stops writing after the queued writes were passed on
+func (q *queuedWriter) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+	return nil
+}
+
+func (q *queuedWriter) closeLocked() {
+	q.closed = true
+	q.signal()
+}
+
+func (q *queuedWriter) signal() {
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queuedWriter) run() {
+	defer q.w.Close()
+	for range q.pending {
+		// pass on everything queued so far in a single write
+		q.mu.Lock()
+		p, closed := q.queue, q.closed
+		q.queue = nil
+		q.mu.Unlock()
+
+		if len(p) > 0 {
+			if _, err := q.w.Write(p); err != nil {
+				q.Close()
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// operatorConn is the connection of a remote operator. Writes time out, so a
+// stalled operator doesn't block the REPL.
+type operatorConn struct {
+	net.Conn
+}
+
+func (c operatorConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(operatorWriteTimeout))
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+// ServeControl exposes the REPL on the given address, so that operators can
+// steer Rán remotely, e.g. using `nc`. Addresses prefixed with "unix:" denote
+// a unix socket. If token is not empty, operators have to send it as their
+// first line. TCP sockets always require a token: if none is given, a random
+// one is generated & printed.
+func (r *Rán) ServeControl(address, token string) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		os.Remove(address) // clean up the socket of a previous run
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("[rán] control socket listening on %s\n", l.Addr())
+	if token == "" && network == "tcp" {
+		token = randomHex(16)
+		fmt.Printf("[rán] control socket token: %s\n", token)
+	}
+
+	go r.repl.serve(l, token)
+}
+
+// serve accepts operators on l, until it is closed
+func (r *REPL) serve(l net.Listener, token string) {
+	var numConns int32
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("[rán] control socket closed: %s", err)
+			return
+		}
+		name := conn.RemoteAddr().String()
+		if n := atomic.AddInt32(&numConns, 1); l.Addr().Network() == "unix" {
+			name = fmt.Sprintf("unix#%d", n) // unix sockets have no remote address
+		}
+		go r.serveOperator(operatorConn{conn}, name, token)
+	}
+}
+
+func (r *REPL) serveOperator(conn operatorConn, name, token string) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+
+	if token != "" {
+		conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		if !scanner.Scan() || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(scanner.Text())), []byte(token)) != 1 {
+			fmt.Fprintln(conn, "invalid token")
+			fmt.Printf("[rán] rejected operator %s: invalid token\n", name)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	// output is queued, so a stalled operator can't block the REPL for others
+	out := newQueuedWriter(conn)
+	fmt.Fprintf(r.out, "[rán] operator %s connected\n", name)
+	r.out.add(out)
+	defer func() {
+		r.out.remove(out)
+		out.Close()
+		fmt.Fprintf(r.out, "[rán] operator %s disconnected\n", name)
+	}()
+
+	r.run(newSession(name, out), scanner)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
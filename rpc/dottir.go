@@ -13,55 +13,166 @@ import (
 	"github.com/SpeckiJ/Hochwasser/render"
 )
 
+// ConnectHevring connects to a Rán at ránAddress, and flutes the tasks it receives.
 func ConnectHevring(ránAddress string, stop chan bool, wg *sync.WaitGroup) *Hevring {
-	h := new(Hevring)
-	rpc.Register(h)
-
-	fmt.Printf("[hevring] greeting Rán at %s\n", ránAddress)
-	conn, err := net.Dial("tcp", ránAddress)
-	if err != nil {
-		log.Fatal(err)
-	}
-	go rpc.ServeConn(conn)
-	fmt.Printf("[hevring] awaiting task from Rán\n")
+	h := connectHevring(ránAddress, &localRunner{}, stop, wg)
 
 	// print performance
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
-			if pixelflut.PerformanceReporter.Enabled {
-				fmt.Println(pixelflut.PerformanceReporter)
+			if p := pixelflut.PerformanceReporter.Snapshot(); p.Enabled {
+				fmt.Println(p)
 			}
 		}
 	}()
 
+	return h
+}
+
+func connectHevring(ránAddress string, runner taskRunner, stop chan bool, wg *sync.WaitGroup) *Hevring {
+	h := newHevring(runner, stop, wg)
+	fmt.Printf("[hevring] greeting Rán at %s\n", ránAddress)
+	if _, err := h.greet(ránAddress, stop); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("[hevring] awaiting task from Rán\n")
+	return h
+}
+
+func newHevring(runner taskRunner, stop chan bool, wg *sync.WaitGroup) *Hevring {
+	h := new(Hevring)
+	h.images = newImgCache(imgCacheSize)
+	h.runner = runner
+	h.server = rpc.NewServer()
+	h.server.Register(h)
+
 	// add listener to stop the task, if this hevring should stop
 	// (either because Rán told us so, or we received an interrupt)
 	h.quit = stop
 	h.wg = wg
 	h.wg.Add(1)
 	go func() {
-		<-h.quit
+		<-stop
+		h.mu.Lock()
 		h.quit = nil
-		if h.taskQuit != nil {
-			close(h.taskQuit)
-			h.taskQuit = nil
-		}
+		h.mu.Unlock()
+		h.runner.stop()
 		h.wg.Done()
 	}()
-
 	return h
 }
 
+// greet opens the control & heartbeat connections to Rán. The returned
+// channel is closed once either connection is lost.
+func (h *Hevring) greet(ránAddress string, stop chan bool) (lost chan struct{}, err error) {
+	id := newHevringID()
+	conn, err := net.Dial("tcp", ránAddress)
+	if err == nil {
+		if err = writeHello(conn, connCtrl, id); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	beatConn, err := net.Dial("tcp", ránAddress)
+	if err == nil {
+		if err = writeHello(beatConn, connBeat, id); err != nil {
+			beatConn.Close()
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	lost = make(chan struct{})
+	var once sync.Once
+	closeConns := func() {
+		once.Do(func() {
+			conn.Close()
+			beatConn.Close()
+			close(lost)
+		})
+	}
+	go func() {
+		h.server.ServeConn(conn)
+		closeConns()
+	}()
+	go func() {
+		h.sendHeartbeats(beatConn, stop)
+		closeConns()
+	}()
+	return lost, nil
+}
+
+// Hevring receives tasks from a Rán, and executes them with its taskRunner.
 type Hevring struct {
-	PreviewPath string
-	task        pixelflut.FlutTask
-	taskQuit    chan bool // if closed, task is stopped.
+	images   *imgCache
+	wg       *sync.WaitGroup
+	runner   taskRunner
+	server   *rpc.Server
+	upstream bool // if set, this Hevring relays tasks of an upstream Rán & outlives it
+
+	mu          sync.Mutex // guards the fields below, as RPCs are served concurrently
+	previewPath string
 	quit        chan bool // if closed, kills this hevring
-	wg          *sync.WaitGroup
 }
 
-type FlutAck struct{ Ok bool }
+// taskRunner executes the tasks received by a Hevring
+type taskRunner interface {
+	run(pixelflut.FlutTask) // replaces the current task
+	stop()
+	fluting() bool
+	performance() pixelflut.Performance
+	setMetrics(enabled bool)
+}
+
+// localRunner flutes tasks from this process
+type localRunner struct {
+	mu       sync.Mutex
+	taskQuit chan bool // if closed, task is stopped.
+}
+
+func (l *localRunner) run(t pixelflut.FlutTask) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// stop old task if new task is received
+	if l.taskQuit != nil {
+		close(l.taskQuit)
+	}
+	l.taskQuit = make(chan bool)
+	go pixelflut.Flut(t, l.taskQuit, nil)
+}
+
+func (l *localRunner) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.taskQuit != nil {
+		close(l.taskQuit)
+		l.taskQuit = nil
+	}
+}
+
+func (l *localRunner) fluting() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.taskQuit != nil
+}
+
+func (l *localRunner) performance() pixelflut.Performance {
+	return pixelflut.PerformanceReporter.Snapshot()
+}
+
+func (l *localRunner) setMetrics(enabled bool) {
+	pixelflut.PerformanceReporter.SetEnabled(enabled)
+}
+
+type FlutAck struct {
+	Ok      bool
+	Missing []string // hashes of images that have to be sent via CacheImage first
+}
 
 type FlutStatus struct {
 	*pixelflut.Performance
@@ -69,62 +180,92 @@ type FlutStatus struct {
 	Fluting bool
 }
 
-func (h *Hevring) Flut(task pixelflut.FlutTask, reply *FlutAck) error {
-	// stop old task if new task is received
-	if h.taskQuit != nil {
-		close(h.taskQuit)
+func (h *Hevring) Flut(ref FlutTaskRef, reply *FlutAck) error {
+	task, missing := h.images.resolve(ref)
+	if len(missing) > 0 {
+		reply.Missing = missing
+		return nil
 	}
 
 	fmt.Printf("[hevring] Rán gave us work!\n%v\n", task)
-	h.task = task
-	h.taskQuit = make(chan bool)
+	h.runner.run(task)
 
-	go pixelflut.Flut(task, h.taskQuit, nil)
-	go h.savePreview(task.Img)
+	h.mu.Lock()
+	go savePreview(h.previewPath, task.Img)
+	h.mu.Unlock()
+
+	reply.Ok = true
+	return nil
+}
 
+// CacheImage receives an image, so it can be referenced by following tasks
+func (h *Hevring) CacheImage(blob ImgBlob, reply *FlutAck) error {
+	img, err := blob.decode()
+	if err != nil {
+		return err
+	}
+	if hash := imgHash(img); hash != blob.Hash {
+		return fmt.Errorf("image hash mismatch: expected %s, got %s", blob.Hash, hash)
+	}
+	fmt.Printf("[hevring] received image %v (%d kB)\n", img.Bounds().Size(), len(blob.PNG)/1024)
+	h.images.putHashed(blob.Hash, img)
 	reply.Ok = true
 	return nil
 }
 
-func (h *Hevring) Status(metrics bool, reply *FlutStatus) error {
-	pixelflut.PerformanceReporter.Enabled = metrics
-	reply.Performance = pixelflut.PerformanceReporter
+// SetMetrics toggles the collection of performance metrics, reported via heartbeats
+func (h *Hevring) SetMetrics(enabled bool, reply *FlutAck) error {
+	h.runner.setMetrics(enabled)
 	reply.Ok = true
-	reply.Fluting = h.taskQuit != nil
 	return nil
 }
 
 func (h *Hevring) Stop(x int, reply *FlutAck) error {
-	if h.taskQuit != nil {
+	if h.runner.fluting() {
 		fmt.Println("[hevring] stopping task")
-		h.task = pixelflut.FlutTask{}
-		close(h.taskQuit)
-		h.taskQuit = nil
+		h.runner.stop()
 		reply.Ok = true
 	}
 	return nil
 }
 
 func (h *Hevring) Die(x int, reply *FlutAck) error {
+	if h.upstream {
+		// keep serving our own clients, and reconnect once upstream is back
+		fmt.Println("[rán] upstream Rán disconnected, pausing relayed task")
+		h.runner.stop()
+		reply.Ok = true
+		return nil
+	}
 	// @robustness: waiting for reply to be sent via timeout
 	// @incomplete: should try to reconnect for a bit first
 	go func() {
 		fmt.Println("[hevring] Rán disconnected, stopping")
 		time.Sleep(100 * time.Millisecond)
-		if h.quit != nil {
-			close(h.quit)
+		h.mu.Lock()
+		quit := h.quit
+		h.quit = nil
+		h.mu.Unlock()
+		if quit != nil {
+			close(quit)
 		}
 	}()
 	reply.Ok = true
 	return nil
 }
 
-func (h Hevring) savePreview(img image.Image) {
-	if h.PreviewPath != "" && img != nil {
-		err := render.WriteImage(h.PreviewPath, img)
+// SetPreviewPath enables writing the current task image to the given PNG file
+func (h *Hevring) SetPreviewPath(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.previewPath = path
+}
+
+func savePreview(path string, img image.Image) {
+	if path != "" && img != nil {
+		err := render.WriteImage(path, img)
 		if err != nil {
 			fmt.Printf("[hevring] unable to write preview: %s\n", err)
 		}
 	}
-
 }
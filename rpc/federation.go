@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+// delays between attempts to reconnect to an upstream Rán
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// ConnectUpstream connects this Rán to an upstream Rán, as if it were a
+// Hevring. Tasks received from upstream are distributed to our own clients,
+// and their aggregated performance is reported upstream. This allows to build
+// a tree of coordinators, e.g. one Rán per site.
+// If upstream disconnects, the relayed task is paused, and we reconnect with backoff.
+func (r *Rán) ConnectUpstream(address string, stop chan bool, wg *sync.WaitGroup) *Hevring {
+	h := newHevring(ránRunner{r}, stop, wg)
+	h.upstream = true
+	go h.stayConnected(address, stop)
+	return h
+}
+
+// stayConnected connects h to the upstream Rán at address, until stop is
+// closed. Lost connections are retried with exponential backoff.
+func (h *Hevring) stayConnected(address string, stop chan bool) {
+	backoff := minReconnectDelay
+	for {
+		fmt.Printf("[rán] connecting to upstream Rán at %s\n", address)
+		lost, err := h.greet(address, stop)
+		if err == nil {
+			backoff = minReconnectDelay
+			select {
+			case <-stop:
+				return
+			case <-lost:
+			}
+			h.runner.stop()
+			fmt.Printf("[rán] lost upstream Rán at %s, paused relayed task\n", address)
+		} else {
+			fmt.Printf("[rán] unable to reach upstream Rán: %s\n", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxReconnectDelay {
+			backoff = maxReconnectDelay
+		}
+	}
+}
+
+// ránRunner executes tasks by delegating them to the clients of a Rán
+type ránRunner struct{ r *Rán }
+
+func (u ránRunner) run(t pixelflut.FlutTask) { u.r.ApplyTask(t) }
+
+func (u ránRunner) stop() {
+	// pause the task, so that clients connecting later don't pick it up
+	t := u.r.GetTask()
+	t.Paused = true
+	u.r.StopTask()
+	u.r.ApplyTask(t)
+}
+
+func (u ránRunner) fluting() bool                      { return u.r.GetTask().IsFlutable() }
+func (u ránRunner) performance() pixelflut.Performance { return u.r.getMetrics() }
+func (u ránRunner) setMetrics(enabled bool)            { u.r.setMetrics(enabled) }
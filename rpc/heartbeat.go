@@ -0,0 +1,170 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+const (
+	heartbeatInterval = 1 * time.Second
+	heartbeatTimeout  = 3 * heartbeatInterval // clients are dropped after missing this many heartbeats
+	helloTimeout      = 5 * time.Second
+)
+
+// A Hevring opens two connections to Rán: on the control connection, Rán
+// calls methods of the Hevring. On the heartbeat connection, the Hevring
+// pushes its status. Each connection starts with a hello line:
+//
+//	hevring <kind> <id>\n
+const (
+	connCtrl = "ctrl"
+	connBeat = "beat"
+)
+
+// Heartbeat is periodically pushed from a Hevring to Rán
+type Heartbeat struct {
+	Seq int
+	FlutStatus
+}
+
+func newHevringID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func writeHello(conn net.Conn, kind, id string) error {
+	_, err := fmt.Fprintf(conn, "hevring %s %s\n", kind, id)
+	return err
+}
+
+// readHello parses the hello line. It reads byte by byte, so no data
+// following the hello line is consumed.
+func readHello(conn net.Conn) (kind, id string, err error) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	line := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for len(line) < 128 {
+		if _, err = conn.Read(b); err != nil {
+			return
+		}
+		if b[0] == '\n' {
+			fields := strings.Fields(string(line))
+			if len(fields) != 3 || fields[0] != "hevring" {
+				break
+			}
+			return fields[1], fields[2], nil
+		}
+		line = append(line, b[0])
+	}
+	return "", "", fmt.Errorf("invalid hello from %v", conn.RemoteAddr())
+}
+
+// sendHeartbeats pushes the status of h to Rán, until the connection fails or
+// stop is closed.
+func (h *Hevring) sendHeartbeats(conn net.Conn, stop chan bool) {
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	for seq := 0; ; seq++ {
+		perf := h.runner.performance()
+		hb := Heartbeat{Seq: seq, FlutStatus: FlutStatus{
+			Performance: &perf,
+			Ok:          true,
+			Fluting:     h.runner.fluting(),
+		}}
+
+		conn.SetWriteDeadline(time.Now().Add(heartbeatTimeout))
+		if err := enc.Encode(hb); err != nil {
+			fmt.Printf("[hevring] unable to send heartbeat: %s\n", err)
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(heartbeatInterval):
+		}
+	}
+}
+
+// receiveHeartbeats reads heartbeats of the client with the given id, until the
+// connection fails or the client is dropped. Connections that aren't paired
+// with a control connection within helloTimeout are closed.
+func (r *Rán) receiveHeartbeats(conn net.Conn, id string) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	dec := gob.NewDecoder(conn)
+	var client *ránClient
+	start := time.Now()
+	for {
+		conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+		hb := Heartbeat{}
+		if err := dec.Decode(&hb); err != nil {
+			if client != nil {
+				if n := r.clients.remove(client); n >= 0 {
+					r.event("client %v disconnected. current clients: %v", client.addr, n)
+				}
+			}
+			return
+		}
+		if client == nil {
+			// heartbeats may arrive before the control connection was registered
+			if client = r.clients.get(id); client == nil {
+				if time.Since(start) > helloTimeout {
+					log.Printf("[rán] closing heartbeat connection from %v without control connection", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+			// stop reading heartbeats once the client is dropped
+			go func(c *ránClient) {
+				select {
+				case <-c.closed:
+					conn.Close()
+				case <-done:
+				}
+			}(client)
+		}
+		client.beat(hb)
+	}
+}
+
+// watchHeartbeats drops clients that missed their heartbeats, and aggregates
+// the metrics of the remaining clients.
+func (r *Rán) watchHeartbeats() {
+	for range time.Tick(heartbeatInterval) {
+		metrics := pixelflut.Performance{}
+		for _, c := range r.clients.list() {
+			status, lastSeen := c.getStatus()
+			if since := time.Since(lastSeen); since > heartbeatTimeout {
+				if n := r.clients.remove(c); n >= 0 {
+					r.event("client %v dropped, no heartbeat since %v. current clients: %v",
+						c.addr, since.Round(time.Millisecond), n)
+				}
+				continue
+			}
+			if status.Performance != nil {
+				metrics.Conns += status.Conns
+				metrics.BytesPerSec += status.BytesPerSec
+				metrics.BytesTotal += status.BytesTotal
+			}
+		}
+
+		r.mu.Lock()
+		metrics.Enabled = r.metrics.Enabled
+		r.metrics = metrics
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+// maxHistory is the number of task states kept for undo. Images are only
+// referenced, so this is cheap unless each command creates a new image.
+const maxHistory = 50
+
+// taskHistory tracks previous states of the task for undo & redo
+type taskHistory struct {
+	past   []historyEntry // most recent last
+	future []historyEntry // undone states, most recently undone last
+}
+
+type historyEntry struct {
+	task pixelflut.FlutTask // the task before (for past) or after (for future) cmd
+	cmd  string
+	at   time.Time
+}
+
+// push records the task state before executing cmd, and drops the redo states
+func (h *taskHistory) push(prev pixelflut.FlutTask, cmd string) {
+	h.past = append(h.past, historyEntry{prev, cmd, time.Now()})
+	if len(h.past) > maxHistory {
+		h.past = h.past[len(h.past)-maxHistory:]
+	}
+	h.future = nil
+}
+
+// undo reverts the last n commands, returning the task state before them
+func (h *taskHistory) undo(current pixelflut.FlutTask, n int) (pixelflut.FlutTask, error) {
+	if n > len(h.past) {
+		return current, fmt.Errorf("can only undo %d commands", len(h.past))
+	}
+	for i := 0; i < n; i++ {
+		e := h.past[len(h.past)-1]
+		h.past = h.past[:len(h.past)-1]
+		h.future = append(h.future, historyEntry{current, e.cmd, e.at})
+		current = e.task
+	}
+	return current, nil
+}
+
+// redo reapplies the last n undone commands, returning the task state after them
+func (h *taskHistory) redo(current pixelflut.FlutTask, n int) (pixelflut.FlutTask, error) {
+	if n > len(h.future) {
+		return current, fmt.Errorf("can only redo %d commands", len(h.future))
+	}
+	for i := 0; i < n; i++ {
+		e := h.future[len(h.future)-1]
+		h.future = h.future[:len(h.future)-1]
+		h.past = append(h.past, historyEntry{current, e.cmd, e.at})
+		current = e.task
+	}
+	return current, nil
+}
+
+func (h *taskHistory) String() string {
+	if len(h.past)+len(h.future) == 0 {
+		return "history is empty"
+	}
+	b := strings.Builder{}
+	for i, e := range h.past {
+		fmt.Fprintf(&b, "\t%3d  %s  %s\n", i-len(h.past), e.at.Format("15:04:05"), e.cmd)
+	}
+	b.WriteString("\t  >  current task\n")
+	for i := len(h.future) - 1; i >= 0; i-- {
+		e := h.future[i]
+		fmt.Fprintf(&b, "\t%+3d  %s  %s\n", len(h.future)-i, e.at.Format("15:04:05"), e.cmd)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
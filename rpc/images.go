@@ -0,0 +1,249 @@
+package rpc
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"sync"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+// FlutTaskRef is the wire format of a FlutTask. The image is referenced by its
+// content hash, and only transferred via ImgBlob if the client misses it.
+type FlutTaskRef struct {
+	pixelflut.FlutTaskOpts
+	ImgHash string
+
+	// frames of animated tasks, referenced like the image
+	FrameHashes []string
+	Delays      []time.Duration
+}
+
+// hashes returns the distinct hashes of all images referenced by the task
+func (ref FlutTaskRef) hashes() (hashes []string) {
+	seen := make(map[string]bool)
+	for _, h := range append([]string{ref.ImgHash}, ref.FrameHashes...) {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// ImgBlob transfers a PNG encoded image, identified by its content hash
+type ImgBlob struct {
+	Hash string
+	Min  image.Point // PNG has no notion of an image origin
+	PNG  []byte
+}
+
+// imgHash returns a hash over the bounds & pixels of img, identifying it across the network
+func imgHash(img *image.NRGBA) string {
+	if img == nil {
+		return ""
+	}
+	h := sha256.New()
+	b := img.Bounds()
+	binary.Write(h, binary.LittleEndian, []int64{
+		int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y),
+	})
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.PixOffset(b.Min.X, y)
+		h.Write(img.Pix[row : row+4*b.Dx()])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func encodeImgBlob(hash string, img *image.NRGBA) (ImgBlob, error) {
+	buf := bytes.Buffer{}
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	err := enc.Encode(&buf, img)
+	return ImgBlob{Hash: hash, Min: img.Rect.Min, PNG: buf.Bytes()}, err
+}
+
+func (b ImgBlob) decode() (*image.NRGBA, error) {
+	img, err := render.DecodeImage(bytes.NewReader(b.PNG))
+	if err != nil {
+		return nil, err
+	}
+	img.Rect = img.Rect.Add(b.Min)
+	return img, nil
+}
+
+// imgCacheSize is the default size of an imgCache in bytes of pixel data
+const imgCacheSize = 256 << 20
+
+// imgCache holds images by their content hash, evicting the least recently used
+// ones when the pixel data of the cached images exceeds max bytes. Images of
+// the active task are pinned, and never evicted: the cache grows instead, so
+// that large animations can still be transferred.
+type imgCache struct {
+	mu      sync.Mutex
+	max     int
+	size    int
+	order   *list.List // of hashes, most recently used at front
+	entries map[string]*imgCacheEntry
+	pinned  map[string]bool
+}
+
+type imgCacheEntry struct {
+	img  *image.NRGBA
+	blob *ImgBlob // encoded lazily
+	elem *list.Element
+}
+
+func newImgCache(max int) *imgCache {
+	return &imgCache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*imgCacheEntry),
+		pinned:  make(map[string]bool),
+	}
+}
+
+// pin protects the images of the given hashes from eviction, replacing
+// previously pinned ones. They don't need to be cached yet.
+func (c *imgCache) pin(hashes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned = make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		c.pinned[h] = true
+	}
+	c.evict()
+}
+
+func (c *imgCache) get(hash string) (*image.NRGBA, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e.elem)
+	return e.img, true
+}
+
+// put adds img to the cache and returns its hash
+func (c *imgCache) put(img *image.NRGBA) string {
+	if img == nil {
+		return ""
+	}
+	hash := imgHash(img)
+	c.putHashed(hash, img)
+	return hash
+}
+
+func (c *imgCache) putHashed(hash string, img *image.NRGBA) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(e.elem)
+		return
+	}
+	c.entries[hash] = &imgCacheEntry{img: img, elem: c.order.PushFront(hash)}
+	c.size += len(img.Pix)
+	c.evict()
+}
+
+// evict removes the least recently used images until the cache fits into max
+// bytes, except for pinned images & the most recently used one. c.mu must be held.
+func (c *imgCache) evict() {
+	for e := c.order.Back(); c.size > c.max && e != nil && e != c.order.Front(); {
+		prev := e.Prev()
+		if hash := e.Value.(string); !c.pinned[hash] {
+			c.size -= len(c.entries[hash].img.Pix)
+			delete(c.entries, hash)
+			c.order.Remove(e)
+		}
+		e = prev
+	}
+}
+
+// ref caches & pins the images of t as active task, and returns its wire format.
+// Hashing is skipped for images that are the same as in prev, which is the
+// result for prevTask.
+func (c *imgCache) ref(t, prevTask pixelflut.FlutTask, prev FlutTaskRef) FlutTaskRef {
+	ref := FlutTaskRef{FlutTaskOpts: t.FlutTaskOpts}
+	if t.Img == prevTask.Img && prev.ImgHash != "" {
+		ref.ImgHash = prev.ImgHash
+	} else {
+		ref.ImgHash = imgHash(t.Img)
+	}
+	images := []*image.NRGBA{t.Img}
+
+	if t.IsAnimated() {
+		ref.Delays = t.Anim.Delays
+		reuse := t.Anim == prevTask.Anim && len(prev.FrameHashes) == len(t.Anim.Frames)
+		for i, frame := range t.Anim.Frames {
+			if reuse {
+				ref.FrameHashes = append(ref.FrameHashes, prev.FrameHashes[i])
+			} else {
+				ref.FrameHashes = append(ref.FrameHashes, imgHash(frame))
+			}
+		}
+		images = append(images, t.Anim.Frames...)
+	}
+
+	// pin before caching, so the frames don't evict each other
+	c.pin(ref.hashes())
+	hashes := append([]string{ref.ImgHash}, ref.FrameHashes...)
+	for i, img := range images {
+		if img != nil {
+			c.putHashed(hashes[i], img) // cached images may have been evicted meanwhile
+		}
+	}
+	return ref
+}
+
+// resolve builds the task referenced by ref from the cached images. If images
+// are missing, their hashes are returned instead. The images of ref are pinned
+// as active task, so that the missing ones can be added without evicting the others.
+func (c *imgCache) resolve(ref FlutTaskRef) (t pixelflut.FlutTask, missing []string) {
+	c.pin(ref.hashes())
+	t.FlutTaskOpts = ref.FlutTaskOpts
+	for _, hash := range ref.hashes() {
+		if _, ok := c.get(hash); !ok {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) > 0 {
+		return t, missing
+	}
+
+	t.Img, _ = c.get(ref.ImgHash)
+	if len(ref.FrameHashes) > 0 {
+		t.Anim = &render.Animation{Delays: ref.Delays}
+		for _, hash := range ref.FrameHashes {
+			frame, _ := c.get(hash)
+			t.Anim.Frames = append(t.Anim.Frames, frame)
+		}
+	}
+	return t, nil
+}
+
+// blob returns the encoded image for hash, encoding it on first request
+func (c *imgCache) blob(hash string) (ImgBlob, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[hash]
+	if !ok {
+		return ImgBlob{}, false, nil
+	}
+	if e.blob == nil {
+		blob, err := encodeImgBlob(hash, e.img)
+		if err != nil {
+			return blob, true, err
+		}
+		e.blob = &blob
+	}
+	return *e.blob, true, nil
+}
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+func TestImgCacheKeepsPinned(t *testing.T) {
+	frameSize := len(testImage(0).Pix)
+	c := newImgCache(3 * frameSize)
+	old := c.put(testImage(100))
+
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		hashes = append(hashes, imgHash(testImage(i)))
+	}
+	c.pin(hashes)
+	for i := range hashes {
+		c.putHashed(hashes[i], testImage(i))
+	}
+	for i, hash := range hashes {
+		if _, ok := c.get(hash); !ok {
+			t.Errorf("pinned frame %d was evicted", i)
+		}
+	}
+	if _, ok := c.get(old); ok {
+		t.Error("unpinned image was not evicted")
+	}
+
+	// once unpinned, the cache shrinks to its size again
+	c.pin(nil)
+	c.put(testImage(100))
+	if c.size > 3*frameSize {
+		t.Errorf("cache holds %d bytes, expected at most %d", c.size, 3*frameSize)
+	}
+}
+
+func TestAnimationLargerThanCache(t *testing.T) {
+	const numFrames = 20
+	frameSize := len(testImage(0).Pix)
+	r, addr := newTestRán(t)
+	r.images = newImgCache(numFrames / 4 * frameSize)
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	runner := &fakeRunner{}
+	h := newHevring(runner, stop, &wg)
+	h.images = newImgCache(numFrames / 4 * frameSize)
+	if _, err := h.greet(addr, stop); err != nil {
+		t.Fatal(err)
+	}
+
+	anim := &render.Animation{}
+	for i := 0; i < numFrames; i++ {
+		anim.Frames = append(anim.Frames, testImage(i))
+		anim.Delays = append(anim.Delays, 100*time.Millisecond)
+	}
+	task := pixelflut.FlutTask{FlutTaskOpts: pixelflut.FlutTaskOpts{Address: "127.0.0.1:1", MaxConns: 1}}
+	task.SetAnimation(anim)
+	r.ApplyTask(task)
+
+	waitFor(t, 2*callTimeout, func() error {
+		got := runner.lastTask()
+		if !got.IsAnimated() {
+			return fmt.Errorf("client didn't receive the animation")
+		}
+		for i, frame := range got.Anim.Frames {
+			if imgHash(frame) != imgHash(anim.Frames[i]) {
+				return fmt.Errorf("frame %d differs", i)
+			}
+		}
+		return nil
+	})
+}
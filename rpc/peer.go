@@ -0,0 +1,490 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+const (
+	gossipInterval = 500 * time.Millisecond
+	peerTimeout    = 3 * time.Second // peers without heartbeat for this long are considered dead
+	peerEvictAfter = 5 * peerTimeout // dead peers are forgotten after this long, so they're no longer gossiped
+	dialTimeout    = 2 * time.Second
+)
+
+// Peer is a member of a swarm of equal Hochwasser instances, coordinating
+// without a central Rán: swarm membership & the current task are spread via
+// gossip. Each alive peer flutes an equally sized part of the task's image,
+// partitioned along the Z-order curve, so that each part is spatially coherent.
+// When peers join or leave, the parts are rebalanced.
+// Implements `Fluter`
+type Peer struct {
+	id     uint64
+	addr   string
+	seeds  []string
+	images *imgCache
+	repl   *REPL
+
+	connsMu sync.Mutex
+	conns   map[string]*rpc.Client
+
+	mu       sync.Mutex // guards the fields below
+	peers    map[uint64]*peerState
+	task     pixelflut.FlutTask
+	taskRef  FlutTaskRef
+	version  TaskVersion
+	assigned assignment // part of the task that is currently fluted
+	numAlive int
+	adopting TaskVersion // newest task whose image is being fetched
+	taskQuit chan bool
+}
+
+// PeerInfo is the gossiped state of a Peer
+type PeerInfo struct {
+	ID        uint64
+	Addr      string
+	Heartbeat uint64 // increased by the peer each gossip round
+}
+
+type peerState struct {
+	PeerInfo
+	seen  time.Time // when Heartbeat last increased, zero if it didn't since discovery
+	added time.Time // when the peer was discovered
+}
+
+// TaskVersion orders tasks across the swarm. The task with the highest
+// version wins, so concurrent changes on different peers converge.
+type TaskVersion struct {
+	Clock  uint64
+	Origin uint64 // ID of the peer that set the task, to break ties
+}
+
+func (v TaskVersion) newerThan(o TaskVersion) bool {
+	return v.Clock > o.Clock || v.Clock == o.Clock && v.Origin > o.Origin
+}
+
+// GossipMsg is exchanged between peers in both directions each gossip round
+type GossipMsg struct {
+	From    PeerInfo
+	Peers   []PeerInfo
+	Task    FlutTaskRef
+	Version TaskVersion
+}
+
+type assignment struct {
+	version TaskVersion
+	part    int
+	parts   int
+}
+
+// peerRPC exposes the RPC methods of a Peer, without exposing its other methods
+type peerRPC struct{ p *Peer }
+
+// JoinSwarm starts a Peer listening at address, which joins the swarm via the
+// given seed addresses. If no seeds are given, it waits to be contacted by
+// other peers. The peer leaves the swarm when stopChan is closed.
+func JoinSwarm(address string, seeds []string, stopChan chan bool, wg *sync.WaitGroup) *Peer {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	p := &Peer{
+		id:     binary.LittleEndian.Uint64(idBytes),
+		seeds:  seeds,
+		images: newImgCache(imgCacheSize),
+		conns:  make(map[string]*rpc.Client),
+		peers:  make(map[uint64]*peerState),
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.addr = l.Addr().String()
+	p.peers[p.id] = &peerState{PeerInfo: PeerInfo{ID: p.id, Addr: p.addr}, seen: time.Now(), added: time.Now()}
+	fmt.Printf("[peer] %016x listening on %s\n", p.id, p.addr)
+
+	server := rpc.NewServer()
+	server.RegisterName("Peer", &peerRPC{p})
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns[conn] = true
+			connsMu.Unlock()
+			go func() {
+				server.ServeConn(conn)
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+			}()
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.gossip(stopChan)
+		p.repl.abortScripts()
+		p.StopTask()
+		// stop answering, so the other peers notice that we left
+		l.Close()
+		connsMu.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		connsMu.Unlock()
+	}()
+
+	// print performance
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			if perf := pixelflut.PerformanceReporter.Snapshot(); perf.Enabled {
+				fmt.Println(perf)
+			}
+		}
+	}()
+
+	p.repl = NewREPL(p)
+	go p.repl.Run(os.Stdin)
+
+	return p
+}
+
+// SetTask assigns a pixelflut.FlutTask to the swarm
+func (p *Peer) SetTask(t pixelflut.FlutTask) {
+	p.ApplyTask(t)
+}
+
+// RunScript runs the REPL commands in the given file in the background
+func (p *Peer) RunScript(path string) {
+	go func() {
+		if err := p.repl.Source(path); err != nil {
+			fmt.Printf("[peer] script failed: %s\n", err)
+		}
+	}()
+}
+
+// GetTask returns the current task
+func (p *Peer) GetTask() pixelflut.FlutTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.task
+}
+
+// ApplyTask sets the task to flut
+func (p *Peer) ApplyTask(t pixelflut.FlutTask) {
+	p.mu.Lock()
+	p.taskRef = p.images.ref(t, p.task, p.taskRef)
+	p.task = t
+	p.version = TaskVersion{Clock: p.version.Clock + 1, Origin: p.id}
+	p.mu.Unlock()
+	p.rebalance()
+}
+
+// StopTask stops fluting the current task
+func (p *Peer) StopTask() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopFlut()
+}
+
+// ToggleMetrics enables or disables bandwidth reporting
+func (p *Peer) ToggleMetrics() {
+	enabled := !pixelflut.PerformanceReporter.Snapshot().Enabled
+	pixelflut.PerformanceReporter.SetEnabled(enabled)
+}
+
+// gossip periodically exchanges state with a random peer, until stop is closed
+func (p *Peer) gossip(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(gossipInterval):
+		}
+
+		p.mu.Lock()
+		self := p.peers[p.id]
+		self.Heartbeat++
+		self.seen = time.Now()
+		p.evictPeers()
+		target := p.randomPeer()
+		msg := p.gossipMsg()
+		p.mu.Unlock()
+
+		if target != "" {
+			reply := GossipMsg{}
+			if err := p.call(target, "Peer.Gossip", msg, &reply); err == nil {
+				p.merge(reply)
+			}
+		}
+		p.rebalance()
+	}
+}
+
+// evictPeers forgets peers that were silent for peerEvictAfter. p.mu must be held.
+func (p *Peer) evictPeers() {
+	for id, s := range p.peers {
+		last := s.seen
+		if last.IsZero() {
+			last = s.added
+		}
+		if id != p.id && time.Since(last) > peerEvictAfter {
+			fmt.Printf("[peer] forgetting peer %016x at %s\n", id, s.Addr)
+			delete(p.peers, id)
+		}
+	}
+}
+
+// randomPeer returns the address of a random alive peer, or a seed if there is none
+func (p *Peer) randomPeer() string {
+	var candidates []string
+	for _, s := range p.peers {
+		if s.ID != p.id && time.Since(s.seen) < peerTimeout {
+			candidates = append(candidates, s.Addr)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.seeds
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[mathrand.Intn(len(candidates))]
+}
+
+func (p *Peer) gossipMsg() GossipMsg {
+	msg := GossipMsg{
+		From:    p.peers[p.id].PeerInfo,
+		Task:    p.taskRef,
+		Version: p.version,
+	}
+	// only spread alive peers, so dead ones are eventually forgotten by all
+	for _, s := range p.peers {
+		if s.ID == p.id || time.Since(s.seen) < peerTimeout {
+			msg.Peers = append(msg.Peers, s.PeerInfo)
+		}
+	}
+	return msg
+}
+
+// merge incorporates the state of another peer into our own. Peers learned
+// via gossip are only considered alive once their heartbeat increases, so
+// stale entries of dead peers don't revive them.
+func (p *Peer) merge(msg GossipMsg) {
+	p.mu.Lock()
+	now := time.Now()
+	for _, info := range msg.Peers {
+		if info.ID == p.id {
+			continue
+		}
+		direct := info.ID == msg.From.ID // we're talking to it, so it's alive
+		s, ok := p.peers[info.ID]
+		if !ok {
+			fmt.Printf("[peer] discovered peer %016x at %s\n", info.ID, info.Addr)
+			s = &peerState{PeerInfo: info, added: now}
+			p.peers[info.ID] = s
+			if direct {
+				s.seen = now
+			}
+		} else if info.Heartbeat > s.Heartbeat || direct {
+			s.PeerInfo = info
+			s.seen = now
+		}
+	}
+	newer := msg.Version.newerThan(p.version) && msg.Version.newerThan(p.adopting)
+	if newer {
+		p.adopting = msg.Version
+	}
+	p.mu.Unlock()
+
+	// fetching the image may take a while, don't block the gossip
+	if newer {
+		go p.adoptTask(msg.Task, msg.Version, msg.From.Addr)
+	}
+}
+
+// adoptTask takes over a task from the swarm, fetching its images from the
+// given peer if we don't have them yet.
+func (p *Peer) adoptTask(ref FlutTaskRef, v TaskVersion, from string) {
+	abort := func() {
+		p.mu.Lock()
+		if p.adopting == v {
+			p.adopting = TaskVersion{} // allow retry
+		}
+		p.images.pin(p.taskRef.hashes())
+		p.mu.Unlock()
+	}
+
+	t, missing := p.images.resolve(ref)
+	if len(missing) > 0 {
+		for _, hash := range missing {
+			blob := ImgBlob{}
+			err := p.callTimeout(from, "Peer.FetchImage", hash, &blob, transferTimeout)
+			var img *image.NRGBA
+			if err == nil {
+				img, err = blob.decode()
+			}
+			if err != nil {
+				fmt.Printf("[peer] unable to fetch image from %s: %s\n", from, err)
+				abort()
+				return
+			}
+			p.images.putHashed(hash, img)
+		}
+		if t, missing = p.images.resolve(ref); len(missing) > 0 {
+			fmt.Printf("[peer] images of task from %s don't fit into the cache\n", from)
+			abort()
+			return
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !v.newerThan(p.version) {
+		return // we got an even newer task meanwhile
+	}
+	fmt.Printf("[peer] adopting task from %016x\n%v\n", v.Origin, t)
+	p.task = t
+	p.taskRef = ref
+	p.version = v
+}
+
+// rebalance determines our part of the task according to our view of the
+// swarm, and restarts fluting if it changed.
+func (p *Peer) rebalance() {
+	p.mu.Lock()
+	var alive []uint64
+	for _, s := range p.peers {
+		if s.ID == p.id || time.Since(s.seen) < peerTimeout {
+			alive = append(alive, s.ID)
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i] < alive[j] })
+	a := assignment{version: p.version, parts: len(alive)}
+	for i, id := range alive {
+		if id == p.id {
+			a.part = i
+		}
+	}
+	if a == p.assigned {
+		p.mu.Unlock()
+		return
+	}
+	if a.parts != p.numAlive {
+		fmt.Printf("[peer] %d peers alive\n", a.parts)
+		p.numAlive = a.parts
+	}
+	t := p.task
+	p.mu.Unlock()
+
+	// splitting animations takes a while, so don't block gossip & RPCs meanwhile.
+	// apply effects before splitting, so effects growing the image (such as
+	// outlines) don't draw over the parts of other peers
+	var numPixels int
+	if t.IsFlutable() {
+		fx := t.FX
+		t.FX = nil
+		t.Img, numPixels = zOrderPart(fx.Apply(t.Img), a.part, a.parts)
+		if t.IsAnimated() {
+			t.Anim = t.Anim.Map(func(frame *image.NRGBA) *image.NRGBA {
+				part, _ := zOrderPart(fx.Apply(frame), a.part, a.parts)
+				return part
+			})
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.version != a.version || p.assigned == a {
+		return // the task changed meanwhile, or a concurrent rebalance installed it
+	}
+	p.stopFlut()
+	p.assigned = a
+	if !t.IsFlutable() {
+		return
+	}
+	fmt.Printf("[peer] fluting part %d/%d (%d px) of task %d\n", a.part+1, a.parts, numPixels, a.version.Clock)
+	p.taskQuit = make(chan bool)
+	go pixelflut.Flut(t, p.taskQuit, nil)
+}
+
+// stopFlut stops fluting our part of the task. p.mu must be held.
+func (p *Peer) stopFlut() {
+	if p.taskQuit != nil {
+		close(p.taskQuit)
+		p.taskQuit = nil
+	}
+	p.assigned = assignment{}
+}
+
+func (p *Peer) call(addr, method string, args, reply interface{}) error {
+	return p.callTimeout(addr, method, args, reply, callTimeout)
+}
+
+// callTimeout invokes method on the peer at addr, reusing connections.
+func (p *Peer) callTimeout(addr, method string, args, reply interface{}, timeout time.Duration) error {
+	p.connsMu.Lock()
+	c, ok := p.conns[addr]
+	p.connsMu.Unlock()
+	if !ok {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			return err
+		}
+		c = rpc.NewClient(conn)
+		p.connsMu.Lock()
+		p.conns[addr] = c
+		p.connsMu.Unlock()
+	}
+
+	err := timedCall(c, method, args, reply, timeout)
+	if err != nil {
+		// reconnect on next call
+		p.connsMu.Lock()
+		if p.conns[addr] == c {
+			delete(p.conns, addr)
+		}
+		p.connsMu.Unlock()
+		c.Close()
+	}
+	return err
+}
+
+// Gossip merges the state of the calling peer, and replies with our state
+func (s *peerRPC) Gossip(msg GossipMsg, reply *GossipMsg) error {
+	s.p.merge(msg)
+	s.p.mu.Lock()
+	*reply = s.p.gossipMsg()
+	s.p.mu.Unlock()
+	return nil
+}
+
+// FetchImage replies with the cached image of the given hash
+func (s *peerRPC) FetchImage(hash string, reply *ImgBlob) error {
+	blob, ok, err := s.p.images.blob(hash)
+	if err != nil {
+		return err
+	} else if !ok {
+		return os.ErrNotExist
+	}
+	*reply = blob
+	return nil
+}
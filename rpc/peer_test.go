@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+)
+
+// fakeCanvas is a pixelflut server recording which pixels were set
+type fakeCanvas struct {
+	l      net.Listener
+	mu     sync.Mutex
+	pixels map[image.Point]bool
+}
+
+func newFakeCanvas(t *testing.T) *fakeCanvas {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCanvas{l: l, pixels: make(map[image.Point]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	return c
+}
+
+func (c *fakeCanvas) serve(conn net.Conn) {
+	defer conn.Close()
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		var p image.Point
+		if _, err := fmt.Sscanf(s.Text(), "PX %d %d", &p.X, &p.Y); err == nil {
+			c.mu.Lock()
+			c.pixels[p] = true
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *fakeCanvas) reset() {
+	c.mu.Lock()
+	c.pixels = make(map[image.Point]bool)
+	c.mu.Unlock()
+}
+
+func (c *fakeCanvas) numPixels() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pixels)
+}
+
+// waitFor polls cond until it returns nil, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, cond func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// checkParts verifies that the peers flut disjoint parts of img, covering all
+// of its pixels, and that the canvas receives each pixel
+func checkParts(t *testing.T, peers []*Peer, img *image.NRGBA, canvas *fakeCanvas) {
+	t.Helper()
+	waitFor(t, 4*peerTimeout, func() error {
+		var version TaskVersion
+		seen := make(map[int]bool)
+		for i, p := range peers {
+			p.mu.Lock()
+			a := p.assigned
+			p.mu.Unlock()
+			if a.parts != len(peers) {
+				return fmt.Errorf("peer %d flutes part %d of %d, expected %d parts", i, a.part, a.parts, len(peers))
+			}
+			if i > 0 && a.version != version {
+				return fmt.Errorf("peer %d flutes task %v, expected %v", i, a.version, version)
+			}
+			if seen[a.part] {
+				return fmt.Errorf("part %d is fluted by multiple peers", a.part)
+			}
+			version = a.version
+			seen[a.part] = true
+		}
+		return nil
+	})
+
+	b := img.Bounds()
+	covered := make([]int, b.Dx()*b.Dy())
+	for _, p := range peers {
+		p.mu.Lock()
+		part, _ := zOrderPart(img, p.assigned.part, p.assigned.parts)
+		p.mu.Unlock()
+		for i := 0; i < len(covered); i++ {
+			if part.Pix[4*i+3] != 0 {
+				covered[i]++
+			}
+		}
+	}
+	for i, n := range covered {
+		if n != 1 {
+			t.Fatalf("pixel %d,%d is part of %d parts", i%b.Dx(), i/b.Dx(), n)
+		}
+	}
+
+	canvas.reset()
+	waitFor(t, 5*time.Second, func() error {
+		if n := canvas.numPixels(); n != len(covered) {
+			return fmt.Errorf("canvas received %d of %d pixels", n, len(covered))
+		}
+		return nil
+	})
+}
+
+func TestSwarmConvergence(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for gossip rounds & peer timeouts")
+	}
+	canvas := newFakeCanvas(t)
+	defer canvas.l.Close()
+
+	const numPeers = 4
+	var wg sync.WaitGroup
+	var peers []*Peer
+	var stops []chan bool
+	for i := 0; i < numPeers; i++ {
+		var seeds []string
+		if i > 0 {
+			seeds = []string{peers[0].addr}
+		}
+		stop := make(chan bool)
+		peers = append(peers, JoinSwarm("127.0.0.1:0", seeds, stop, &wg))
+		stops = append(stops, stop)
+	}
+	defer func() {
+		for _, stop := range stops {
+			if stop != nil {
+				close(stop)
+			}
+		}
+		wg.Wait()
+	}()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.SetNRGBA(3, 4, color.NRGBA{0xff, 0, 0, 0xff})
+	peers[1].SetTask(pixelflut.FlutTask{
+		FlutTaskOpts: pixelflut.FlutTaskOpts{Address: canvas.l.Addr().String(), MaxConns: 1},
+		Img:          img,
+	})
+	checkParts(t, peers, img, canvas)
+
+	// kill a peer, the others take over its part
+	close(stops[2])
+	stops[2] = nil
+	peers = append(peers[:2], peers[3:]...)
+	checkParts(t, peers, img, canvas)
+
+	// the dead peer is forgotten by all, instead of being gossiped forever
+	waitFor(t, peerEvictAfter+4*peerTimeout, func() error {
+		for i, p := range peers {
+			p.mu.Lock()
+			n := len(p.peers)
+			p.mu.Unlock()
+			if n != len(peers) {
+				return fmt.Errorf("peer %d knows %d peers, expected %d", i, n, len(peers))
+			}
+		}
+		return nil
+	})
+}
+
+func TestMergeIgnoresStalePeers(t *testing.T) {
+	p := &Peer{id: 1, peers: map[uint64]*peerState{1: {PeerInfo: PeerInfo{ID: 1}, seen: time.Now()}}}
+	sender := PeerInfo{ID: 2, Addr: "sender", Heartbeat: 5}
+	stale := PeerInfo{ID: 3, Addr: "stale", Heartbeat: 7}
+
+	p.merge(GossipMsg{From: sender, Peers: []PeerInfo{sender, stale}})
+	if p.peers[2].seen.IsZero() {
+		t.Error("peer we talked to directly is not considered alive")
+	}
+	if !p.peers[3].seen.IsZero() {
+		t.Error("peer learned via gossip is considered alive before its heartbeat increased")
+	}
+
+	p.merge(GossipMsg{From: sender, Peers: []PeerInfo{sender, stale}})
+	if !p.peers[3].seen.IsZero() {
+		t.Error("peer with unchanged heartbeat is considered alive")
+	}
+
+	stale.Heartbeat++
+	p.merge(GossipMsg{From: sender, Peers: []PeerInfo{sender, stale}})
+	if p.peers[3].seen.IsZero() {
+		t.Error("peer with increased heartbeat is not considered alive")
+	}
+
+	// dead peers are no longer spread, and forgotten eventually
+	p.peers[3].seen = time.Now().Add(-2 * peerTimeout)
+	for _, info := range p.gossipMsg().Peers {
+		if info.ID == 3 {
+			t.Error("dead peer is gossiped")
+		}
+	}
+	p.peers[3].seen = time.Now().Add(-2 * peerEvictAfter)
+	p.evictPeers()
+	if _, ok := p.peers[3]; ok {
+		t.Error("dead peer is not forgotten")
+	}
+	if _, ok := p.peers[1]; !ok {
+		t.Error("peer forgot itself")
+	}
+}
@@ -0,0 +1,286 @@
+package rpc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playlist plays stored tasks one after another, each either for a fixed
+// duration, or starting at a given time of day.
+type playlist struct {
+	out     io.Writer
+	mu      sync.Mutex
+	entries []playlistEntry
+	loop    bool
+	shuffle bool
+	current int           // index of the playing entry, -1 if none
+	stop    chan struct{} // non-nil while playing
+	skip    chan struct{}
+}
+
+type playlistEntry struct {
+	task     string        // name of a stored task
+	duration time.Duration // 0: play until the next entry's start time, or until skipped
+	at       time.Duration // time of day to start the entry at, since midnight
+	hasAt    bool
+}
+
+func (e playlistEntry) String() string {
+	s := e.task
+	if e.duration > 0 {
+		s += " " + e.duration.String()
+	}
+	if e.hasAt {
+		s += fmt.Sprintf(" @%02d:%02d", int(e.at.Hours()), int(e.at.Minutes())%60)
+	}
+	return s
+}
+
+// parsePlaylistEntry parses `<task name> [<duration>] [@<hh:mm>]`
+func parsePlaylistEntry(args []string) (e playlistEntry, err error) {
+	for len(args) > 1 {
+		last := args[len(args)-1]
+		if strings.HasPrefix(last, "@") {
+			t, err := time.Parse("15:04", last[1:])
+			if err != nil {
+				return e, fmt.Errorf("invalid start time '%s', expected @hh:mm", last)
+			}
+			e.at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+			e.hasAt = true
+		} else if d, err := time.ParseDuration(last); err == nil {
+			e.duration = d
+		} else {
+			break
+		}
+		args = args[:len(args)-1]
+	}
+	e.task = strings.Join(args, " ")
+	if e.task == "" {
+		return e, fmt.Errorf("must specify task name")
+	}
+	return e, nil
+}
+
+// nextOccurrence returns when the entry's start time is reached next
+func (e playlistEntry) nextOccurrence() time.Time {
+	now := time.Now()
+	y, m, d := now.Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(e.at)
+	if t.Before(now) {
+		t = t.Add(24 * time.Hour)
+	}
+	return t
+}
+
+func newPlaylist(out io.Writer) *playlist {
+	return &playlist{out: out, current: -1}
+}
+
+// load reads a playlist file. Each line holds an entry as for `playlist add`,
+// or one of the directives `loop` and `shuffle`. Lines starting with # are ignored.
+func (p *playlist) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []playlistEntry
+	loop, shuffle := false, false
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "loop":
+			loop = true
+		case line == "shuffle":
+			shuffle = true
+		default:
+			e, err := parsePlaylistEntry(strings.Fields(line))
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = entries
+	p.loop = loop
+	p.shuffle = shuffle
+	return nil
+}
+
+func (p *playlist) add(e playlistEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = append(p.entries, e)
+}
+
+func (p *playlist) remove(i int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i < 0 || i >= len(p.entries) {
+		return fmt.Errorf("no playlist entry %d", i+1)
+	}
+	p.entries = append(p.entries[:i], p.entries[i+1:]...)
+	return nil
+}
+
+func (p *playlist) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = nil
+}
+
+func (p *playlist) toggleLoop() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loop = !p.loop
+	return p.loop
+}
+
+func (p *playlist) toggleShuffle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shuffle = !p.shuffle
+	return p.shuffle
+}
+
+func (p *playlist) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := fmt.Sprintf("playlist: %d entries	loop %v	shuffle %v	playing %v",
+		len(p.entries), p.loop, p.shuffle, p.stop != nil)
+	for i, e := range p.entries {
+		marker := " "
+		if i == p.current {
+			marker = ">"
+		}
+		s += fmt.Sprintf("\n	%s %d. %s", marker, i+1, e)
+	}
+	return s
+}
+
+// start plays the playlist in the background, calling apply with the task name of each entry.
+func (p *playlist) start(apply func(task string) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return fmt.Errorf("playlist is playing already")
+	}
+	if len(p.entries) == 0 {
+		return fmt.Errorf("playlist is empty")
+	}
+	p.stop = make(chan struct{})
+	p.skip = make(chan struct{}, 1)
+	go p.play(apply, p.stop, p.skip)
+	return nil
+}
+
+func (p *playlist) halt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+		p.current = -1
+	}
+}
+
+// next skips to the next entry, without waiting for its start time
+func (p *playlist) next() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop == nil {
+		return
+	}
+	select {
+	case p.skip <- struct{}{}:
+	default:
+	}
+}
+
+func (p *playlist) play(apply func(task string) error, stop, skip chan struct{}) {
+	var order []int
+	failures := 0
+	for i := 0; ; i++ {
+		p.mu.Lock()
+		if i >= len(order) {
+			passDone := order != nil
+			if len(p.entries) == 0 || passDone && (!p.loop || failures == len(order)) {
+				fmt.Fprintln(p.out, "[rán] playlist finished")
+				if p.stop == stop {
+					p.stop = nil
+					p.current = -1
+				}
+				p.mu.Unlock()
+				return
+			}
+			order = rand.Perm(len(p.entries))
+			if !p.shuffle {
+				for j := range order {
+					order[j] = j
+				}
+			}
+			i = 0
+			failures = 0
+		}
+		if order[i] >= len(p.entries) {
+			p.mu.Unlock()
+			continue // entry was removed meanwhile
+		}
+		entry := p.entries[order[i]]
+		var next *playlistEntry
+		if i+1 < len(order) && order[i+1] < len(p.entries) {
+			next = &p.entries[order[i+1]]
+		} else if p.loop && !p.shuffle {
+			next = &p.entries[0]
+		}
+		var end <-chan time.Time // nil blocks forever
+		if entry.duration == 0 && next != nil && next.hasAt {
+			end = time.After(time.Until(next.nextOccurrence()))
+		}
+		p.mu.Unlock()
+
+		if entry.hasAt {
+			select {
+			case <-stop:
+				return
+			case <-skip:
+			case <-time.After(time.Until(entry.nextOccurrence())):
+			}
+		}
+
+		p.mu.Lock()
+		p.current = order[i]
+		p.mu.Unlock()
+		fmt.Fprintf(p.out, "[rán] playlist: playing '%s' (%d/%d)\n", entry.task, i+1, len(order))
+		if err := apply(entry.task); err != nil {
+			fmt.Fprintf(p.out, "[rán] playlist: %s\n", err)
+			failures++
+			continue
+		}
+
+		if entry.duration > 0 {
+			end = time.After(entry.duration)
+		}
+		select {
+		case <-stop:
+			return
+		case <-skip:
+		case <-end:
+		}
+	}
+}
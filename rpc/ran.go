@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
+	"os"
 	"sync"
 	"time"
 
@@ -14,16 +14,25 @@ import (
 // Rán represents the RPC hub, used to coordinate `Hevring` clients.
 // Implements `Fluter`
 type Rán struct {
-	clients []*rpc.Client
+	clients clientManager
+	repl    *REPL
+	images  *imgCache // images of recent tasks, to be requested by clients
+
+	mu      sync.Mutex // guards the fields below
 	task    pixelflut.FlutTask
+	taskRef FlutTaskRef
 	metrics pixelflut.Performance
+	events  []string // most recent client events
 }
 
+const maxEvents = 50
+
 // SummonRán sets up the RPC master, accepting connections at addres (":1234")
 // Connects calls methods on each client's rpc provider, killing all clients
 // when stopChan is closed.
 func SummonRán(address string, stopChan chan bool, wg *sync.WaitGroup) *Rán {
 	r := new(Rán)
+	r.images = newImgCache(imgCacheSize)
 
 	l, err := net.Listen("tcp", address)
 	if err != nil {
@@ -38,102 +47,210 @@ func SummonRán(address string, stopChan chan bool, wg *sync.WaitGroup) *Rán {
 			if err != nil {
 				log.Fatal(err)
 			}
-			client := rpc.NewClient(conn)
-			r.clients = append(r.clients, client)
-			fmt.Printf("[rán] client connected (%v). current clients: %v\n",
-				conn.RemoteAddr(), len(r.clients))
-
-			if r.task.IsFlutable() {
-				ack := FlutAck{}
-				err = client.Call("Hevring.Flut", r.task, &ack)
-				if err != nil || !ack.Ok {
-					log.Printf("[rán] client didn't accept task")
-				}
-			}
+			go r.handleConn(conn)
 		}
 	}()
 
-	// poll clients
-	go func() {
-		for {
-			time.Sleep(100 * time.Millisecond)
-
-			var clients []*rpc.Client
-
-			r.metrics.Conns = 0
-			r.metrics.BytesPerSec = 0
-			r.metrics.BytesTotal = 0
-
-			for _, c := range r.clients {
-				status := FlutStatus{}
-				err := c.Call("Hevring.Status", r.metrics.Enabled, &status)
-				if err == nil && status.Ok {
-					clients = append(clients, c)
-					r.metrics.Conns += status.Conns
-					r.metrics.BytesPerSec += status.BytesPerSec
-					r.metrics.BytesTotal += status.BytesTotal
-				}
-			}
-			if len(r.clients) != len(clients) {
-				fmt.Printf("[rán] client disconnected. current clients: %v\n", len(clients))
-			}
-			r.clients = clients
-		}
-	}()
+	go r.watchHeartbeats()
 
 	// print performance
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
-			if r.metrics.Enabled {
-				fmt.Println(r.metrics)
+			if m := r.getMetrics(); m.Enabled {
+				fmt.Println(m)
 			}
 		}
 	}()
 
-	go RunREPL(r)
+	r.repl = NewREPL(r)
+	go r.repl.Run(os.Stdin)
+	wg.Add(1)
 	go r.handleExit(stopChan, wg)
 
 	return r
 }
 
-func (r *Rán) getTask() pixelflut.FlutTask { return r.task }
+// StartPlaylist plays the stored tasks listed in the given playlist file
+func (r *Rán) StartPlaylist(path string) error { return r.repl.StartPlaylist(path) }
+
+// RunScript runs the REPL commands in the given file in the background
+func (r *Rán) RunScript(path string) {
+	go func() {
+		if err := r.repl.Source(path); err != nil {
+			fmt.Printf("[rán] script failed: %s\n", err)
+		}
+	}()
+}
+
+// SetControlFiles sets the directory that remote operators & the web dashboard
+// may read files from, e.g. via the img or source commands. If empty, they
+// can't access files of the server.
+func (r *Rán) SetControlFiles(dir string) { r.repl.SetFileDir(dir) }
+
+// SetTaskStore sets the store of named tasks available to the REPL
+func (r *Rán) SetTaskStore(s *TaskStore) { r.repl.SetTaskStore(s) }
+
+// GetTask returns the current task
+func (r *Rán) GetTask() pixelflut.FlutTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.task
+}
+
+func (r *Rán) getMetrics() pixelflut.Performance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics
+}
+
+// ToggleMetrics enables or disables bandwidth reporting
+func (r *Rán) ToggleMetrics() {
+	r.setMetrics(!r.getMetrics().Enabled)
+}
+
+// setMetrics toggles the collection of performance metrics on all clients
+func (r *Rán) setMetrics(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics.Enabled = enabled
+	for _, c := range r.clients.list() {
+		go r.sendMetricsEnabled(c, enabled)
+	}
+}
+
+func (r *Rán) sendMetricsEnabled(c *ránClient, enabled bool) {
+	if err := c.call("Hevring.SetMetrics", enabled, &FlutAck{}, callTimeout); err != nil {
+		log.Printf("[rán] client %v didn't toggle metrics: %s", c.addr, err)
+	}
+}
+
+// handleConn registers a new connection of a Hevring, according to its hello
+func (r *Rán) handleConn(conn net.Conn) {
+	kind, id, err := readHello(conn)
+	if err != nil {
+		log.Printf("[rán] rejecting connection: %s", err)
+		conn.Close()
+		return
+	}
+
+	switch kind {
+	case connBeat:
+		r.receiveHeartbeats(conn, id)
+
+	case connCtrl:
+		client := newRánClient(conn, id)
+
+		// register under lock, so the client can't miss a concurrently applied task
+		r.mu.Lock()
+		n := r.clients.add(client)
+		if r.task.IsFlutable() {
+			r.enqueueTask(client, r.taskRef)
+		}
+		if r.metrics.Enabled {
+			go r.sendMetricsEnabled(client, true)
+		}
+		r.mu.Unlock()
+		r.event("client %v connected. current clients: %v", client.addr, n)
 
-func (r *Rán) toggleMetrics() {
-	r.metrics.Enabled = !r.metrics.Enabled
+	default:
+		log.Printf("[rán] rejecting connection of unknown kind '%s'", kind)
+		conn.Close()
+	}
+}
+
+// event logs a notable change of the client swarm
+func (r *Rán) event(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Printf("[rán] %s\n", msg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, time.Now().Format("15:04:05 ")+msg)
+	if len(r.events) > maxEvents {
+		r.events = r.events[len(r.events)-maxEvents:]
+	}
 }
 
-func (r *Rán) applyTask(t pixelflut.FlutTask) {
+func (r *Rán) getEvents() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// ApplyTask distributes the task to all clients. Does not block on slow clients.
+func (r *Rán) ApplyTask(t pixelflut.FlutTask) {
+	r.mu.Lock()
+	r.taskRef = r.images.ref(t, r.task, r.taskRef)
 	r.task = t
+	defer r.mu.Unlock()
+
 	if !t.IsFlutable() {
 		return
 	}
-	for i, c := range r.clients {
-		ack := FlutAck{}
-		err := c.Call("Hevring.Flut", r.task, &ack)
-		if err != nil || !ack.Ok {
-			log.Printf("[rán] client %d didn't accept task", i)
+	for _, c := range r.clients.list() {
+		r.enqueueTask(c, r.taskRef)
+	}
+}
+
+func (r *Rán) enqueueTask(c *ránClient, ref FlutTaskRef) {
+	c.enqueue(func() {
+		if err := r.sendTask(c, ref); err != nil {
+			log.Printf("[rán] client %v didn't accept task: %s", c.addr, err)
 		}
+	})
+}
+
+// sendTask assigns the task to a client, transferring images only if the
+// client doesn't have them cached already.
+func (r *Rán) sendTask(c *ránClient, ref FlutTaskRef) error {
+	ack := FlutAck{}
+	if err := c.call("Hevring.Flut", ref, &ack, callTimeout); err != nil {
+		return err
 	}
+	if len(ack.Missing) > 0 {
+		for _, hash := range ack.Missing {
+			blob, ok, err := r.images.blob(hash)
+			if err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("image %s is not available anymore", hash)
+			}
+			if err := c.call("Hevring.CacheImage", blob, &FlutAck{}, transferTimeout); err != nil {
+				return err
+			}
+		}
+		ack = FlutAck{}
+		if err := c.call("Hevring.Flut", ref, &ack, callTimeout); err != nil {
+			return err
+		}
+	}
+	if !ack.Ok {
+		return fmt.Errorf("task rejected")
+	}
+	return nil
 }
 
-func (r *Rán) stopTask() {
-	// @robustness: errorchecking
-	for _, c := range r.clients {
-		ack := FlutAck{}
-		c.Call("Hevring.Stop", 0, &ack) // @speed: async
+// StopTask makes all clients stop fluting
+func (r *Rán) StopTask() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.clients.list() {
+		c := c
+		c.enqueue(func() {
+			if err := c.call("Hevring.Stop", 0, &FlutAck{}, callTimeout); err != nil {
+				log.Printf("[rán] client %v didn't stop: %s", c.addr, err)
+			}
+		})
 	}
 }
 
 func (r *Rán) handleExit(stopChan <-chan bool, wg *sync.WaitGroup) {
-	wg.Add(1)
 	defer wg.Done()
 	<-stopChan
-	for _, c := range r.clients {
-		ack := FlutAck{}
-		c.Call("Hevring.Die", 0, &ack) // @speed: async
-	}
-	// FIXME: why the fuck are we quitting before this loop is complete?
+	r.repl.abortScripts()
+	r.clients.broadcast(func(c *ránClient) {
+		c.call("Hevring.Die", 0, &FlutAck{}, callTimeout)
+	})
 }
 
 // SetTask assigns a pixelflut.FlutTask to Rán, distributing it to all clients
@@ -141,5 +258,5 @@ func (r *Rán) SetTask(t pixelflut.FlutTask) {
 	// @incomplete: smart task creation:
 	//   fetch server state & sample foreign activity in image regions. assign
 	//   subregions to clients (per connection), considering their bandwidth.
-	r.applyTask(t)
+	r.ApplyTask(t)
 }
@@ -3,263 +3,1193 @@ package rpc
 import (
 	"bufio"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 
 	"github.com/SpeckiJ/Hochwasser/pixelflut"
 	"github.com/SpeckiJ/Hochwasser/render"
+	"golang.org/x/image/font/basicfont"
 )
 
-// Fluter implements flut operations that can be triggered via a REPL
+// Fluter implements flut operations that can be triggered via a REPL.
+// Custom Fluters may extend the REPL with their own commands, see REPL.Register.
 type Fluter interface {
-	getTask() pixelflut.FlutTask
-	applyTask(pixelflut.FlutTask)
-	stopTask()
-	toggleMetrics()
+	GetTask() pixelflut.FlutTask
+	ApplyTask(pixelflut.FlutTask)
+	StopTask()
+	ToggleMetrics()
 }
 
 const commandMode = "cmd"
 const textMode = "txt"
 
+var errNoImage = errors.New("no image set")
+
+// REPL holds the state for controlling a Fluter via commands.
+// Commands may be executed concurrently from several sessions, their results
+// are broadcast to all connected operators.
+type REPL struct {
+	f         Fluter
+	mu        sync.Mutex
+	out       *broadcaster
+	console   *session
+	taskStore *TaskStore
+	playlist  *playlist
+	history   taskHistory
+	resume    chan struct{} // continues a script waiting for the operator
+	fileDir   string        // directory remote operators may read files from
+
+	scriptMu sync.Mutex
+	scripts  int           // number of running scripts
+	abort    chan struct{} // closed to abort the running scripts
+
+	cmdMu    sync.RWMutex
+	commands []*Command
+}
+
+// session holds the state of a single operator of the REPL
+type session struct {
+	name     string    // echoed along with each command to other operators, empty for the console
+	out      io.Writer // receives output only relevant to this operator, such as help
+	mode     string
+	text     render.TextStyle
+	fontName string
+	tee      bool          // also write output broadcast to the operators to out
+	abort    chan struct{} // closed if the script of this session is aborted, nil for operators
+	// sandboxed sessions belong to remote operators, the web dashboard or
+	// scripts started by them, and may only read files within REPL.fileDir
+	sandboxed bool
+	dir       string // directory of the running script, nested sources are relative to it
+}
+
+func newSession(name string, out io.Writer) *session {
+	return &session{
+		name:      name,
+		out:       out,
+		mode:      commandMode,
+		text:      render.DefaultTextStyle(),
+		fontName:  render.BasicFont,
+		sandboxed: name != "",
+	}
+}
+
+// NewREPL initializes a REPL for the given Fluter
+func NewREPL(f Fluter) *REPL {
+	out := newBroadcaster(os.Stdout)
+	r := &REPL{
+		f:         f,
+		out:       out,
+		console:   newSession("", os.Stdout),
+		taskStore: NewTaskStore(),
+		playlist:  newPlaylist(out),
+		resume:    make(chan struct{}),
+		abort:     make(chan struct{}),
+	}
+	r.registerBuiltins()
+	return r
+}
+
 // RunREPL starts reading os.Stdin for commands to apply to the given Fluter
 func RunREPL(f Fluter) {
-	mode := commandMode
-	textSize := 10.0
-	var textCol image.Image = image.White
-	var bgCol image.Image = image.Transparent
-	var taskStore = make(map[string]pixelflut.FlutTask)
+	NewREPL(f).Run(os.Stdin)
+}
+
+// Run reads commands from the given reader line by line, until it is exhausted
+func (r *REPL) Run(in io.Reader) {
+	r.run(r.console, bufio.NewScanner(in))
+}
 
-	fmt.Print("[rán] REPL is active. ")
-	printHelp()
+// run executes the commands read by scanner in the given session
+func (r *REPL) run(s *session, scanner *bufio.Scanner) {
+	fmt.Fprint(s.out, "[rán] REPL is active. ")
+	r.printHelp(s.out)
 
-	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		inputStr := scanner.Text()
-
-		switch strings.ToLower(mode) {
-		case textMode:
-			if strings.ToLower(inputStr) == commandMode {
-				fmt.Println("[rán] command mode")
-				mode = commandMode
-				continue
-			}
-			t := f.getTask()
-			t.Img = render.RenderText(inputStr, textSize, textCol, bgCol)
-			f.applyTask(t)
-
-		case commandMode:
-			input := strings.Split(inputStr, " ")
-			cmd := strings.ToLower(input[0])
-			args := input[1:]
-			t := f.getTask()
-			printTask := true
-
-			switch cmd {
-			case "stop":
-				t.Paused = true
-				f.stopTask()
-				printTask = false
-
-			case "start":
-				t.Paused = false
-
-			case "toggle", ".":
-				t.Paused = !t.Paused
-				if t.Paused {
-					f.stopTask()
-					printTask = false
-				}
+		r.exec(s, strings.TrimRight(scanner.Text(), "\r"))
+	}
+}
 
-			case "store", "save":
-				printTask = false
-				if len(args) == 0 {
-					fmt.Println("must specify name")
-				} else {
-					taskStore[strings.Join(args, " ")] = t
-				}
-				continue
+// Exec parses and executes a single line of input in the console session
+func (r *REPL) Exec(inputStr string) {
+	r.exec(r.console, inputStr)
+}
 
-			case "load", "l":
-				if len(args) == 0 {
-					fmt.Println("must specify name")
-				} else {
-					t = taskStore[strings.Join(args, " ")]
-				}
+// exec runs a line of input in session s. Errors are printed, and returned
+// so that callers can signal them in other ways, such as the web dashboard.
+func (r *REPL) exec(s *session, inputStr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.f
 
-			case "offset", "of":
-				if len(args) == 1 && args[0] == "rand" {
-					t.RandOffset = true
-					t.Offset = image.Point{}
-				} else if len(args) == 2 {
-					t.RandOffset = false
-					x, err := strconv.Atoi(args[0])
-					y, err2 := strconv.Atoi(args[1])
-					if err == nil && err2 == nil {
-						t.Offset = image.Pt(x, y)
-					}
-				}
+	if s.name != "" {
+		fmt.Fprintf(r.out, "[rán] %s> %s\n", s.name, inputStr)
+	}
+	// output broadcast to the operators, which the session may not receive otherwise
+	var out io.Writer = r.out
+	if s.tee {
+		out = io.MultiWriter(r.out, s.out)
+	}
 
-			case "connections", "c":
-				if len(args) == 1 {
-					if conns, err := strconv.Atoi(args[0]); err == nil {
-						t.MaxConns = conns
-					}
-				}
+	switch strings.ToLower(s.mode) {
+	case textMode:
+		if strings.ToLower(inputStr) == commandMode {
+			fmt.Fprintln(s.out, "[rán] command mode")
+			s.mode = commandMode
+			return nil
+		}
+		t := f.GetTask()
+		r.history.push(t, "text: "+inputStr)
+		t.Img, t.Anim = render.RenderText(unescapeText(inputStr), s.text), nil
+		f.ApplyTask(t)
 
-			case "host", "address", "a":
-				if len(args) == 1 {
-					t.Address = args[0]
-				}
+	case commandMode:
+		name, _ := nextField(inputStr)
+		if name == "" {
+			return nil
+		}
+		cmd, rest := r.resolve(inputStr)
+		if cmd == nil {
+			err := fmt.Errorf("unknown command '%s', see 'help'", name)
+			fmt.Fprintf(s.out, "[rán] %s\n", err)
+			return err
+		}
+		if cmd.Run == nil {
+			fmt.Fprintf(s.out, "[rán] '%s' requires a subcommand:\n", cmd.path)
+			r.printCommandHelp(s.out, cmd.path)
+			return fmt.Errorf("'%s' requires a subcommand", cmd.path)
+		}
+		args, err := cmd.parseArgs(rest)
+		if err != nil {
+			fmt.Fprintf(s.out, "%s\nusage: %s\n", err, cmd.usage())
+			return err
+		}
 
-			case "order", "o":
-				if len(args) == 1 {
-					t.RenderOrder = pixelflut.NewOrder(args[0])
-				}
+		prev := f.GetTask()
+		ctx := &Context{Fluter: f, Task: prev, Out: out, session: s, args: args}
+		if err := cmd.Run(ctx); err != nil {
+			fmt.Fprintln(out, err)
+			return err
+		}
+		if cmd.Task && !ctx.keepTask {
+			r.history.push(prev, inputStr)
+			fmt.Fprintln(out, ctx.Task)
+			f.ApplyTask(ctx.Task)
+		}
+	}
+	return nil
+}
 
-			case "rgbsplit":
-				t.RGBSplit = !t.RGBSplit
+// registerBuiltins registers the commands available for all Fluters
+func (r *REPL) registerBuiltins() {
+	r.Register(&Command{
+		Name: "start", Group: "tasks", Help: "start fluting", Task: true,
+		Run: func(ctx *Context) error {
+			ctx.Task.Paused = false
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "stop", Group: "tasks", Help: "pause fluting",
+		Run: func(ctx *Context) error {
+			ctx.Task.Paused = true
+			ctx.Fluter.StopTask()
+			ctx.Fluter.ApplyTask(ctx.Task)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "toggle", Aliases: []string{"."}, Group: "tasks", Help: "toggle fluting",
+		Run: func(ctx *Context) error {
+			ctx.Task.Paused = !ctx.Task.Paused
+			if ctx.Task.Paused {
+				ctx.Fluter.StopTask()
+			} else {
+				fmt.Fprintln(ctx.Out, ctx.Task)
+			}
+			ctx.Fluter.ApplyTask(ctx.Task)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "status", Group: "tasks", Help: "print current task",
+		Run: func(ctx *Context) error {
+			fmt.Fprintln(ctx.Out, ctx.Task)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "save", Aliases: []string{"store"}, Group: "tasks", Help: "store current task",
+		Args: []Arg{{Name: "name", Type: ArgText, Complete: r.storedTasks}},
+		Run: func(ctx *Context) error {
+			return r.taskStore.Save(ctx.Str("name"), ctx.Task)
+		},
+	})
+	r.Register(&Command{
+		Name: "load", Aliases: []string{"l"}, Group: "tasks", Help: "load previously stored task", Task: true,
+		Args: []Arg{{Name: "name", Type: ArgText, Complete: r.storedTasks}},
+		Run: func(ctx *Context) (err error) {
+			ctx.Task, err = r.taskStore.Load(ctx.Str("name"))
+			return err
+		},
+	})
+	r.Register(&Command{
+		Name: "list", Aliases: []string{"ls"}, Group: "tasks", Help: "list stored tasks",
+		Run: func(ctx *Context) error {
+			for _, name := range r.taskStore.List() {
+				fmt.Fprintln(ctx.Out, name)
+			}
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "delete", Aliases: []string{"rm"}, Group: "tasks", Help: "delete stored task",
+		Args: []Arg{{Name: "name", Type: ArgText, Complete: r.storedTasks}},
+		Run: func(ctx *Context) error {
+			return r.taskStore.Delete(ctx.Str("name"))
+		},
+	})
 
-			case "txt":
-				if len(args) > 0 {
-					if size, err := strconv.Atoi(args[0]); err == nil {
-						textSize = float64(size)
-					}
+	r.registerPlaylist()
+
+	r.Register(&Command{
+		Name: "source", Group: "scripts", Help: "run REPL commands from file",
+		Args: []Arg{{Name: "file", Type: ArgText}},
+		Run: func(ctx *Context) error {
+			path, err := r.resolvePath(ctx.session, ctx.Str("file"))
+			if err != nil {
+				return err
+			}
+			// scripts execute commands themselves, so don't block this one
+			go func(path string) {
+				if err := r.sourceFrom(ctx.session, path); err != nil {
+					fmt.Fprintln(r.out, err)
 				}
-				if len(args) > 1 {
-					textCol = parseColorOrPalette(args[1])
+			}(path)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "continue", Group: "scripts", Help: "resume script paused by 'wait'",
+		Run: func(ctx *Context) error {
+			r.resumeScript()
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "abort", Group: "scripts", Help: "stop all running scripts",
+		Run: func(ctx *Context) error {
+			if r.abortScripts() == 0 {
+				fmt.Fprintln(r.out, "no script is running")
+			}
+			return nil
+		},
+	})
+
+	r.Register(&Command{
+		Name: "img", Aliases: []string{"i"}, Group: "content", Task: true,
+		Help: "set image, animated GIF / APNG or directory of numbered PNGs",
+		Args: []Arg{{Name: "filepath", Type: ArgText}},
+		Run: func(ctx *Context) error {
+			path, err := r.resolvePath(ctx.session, ctx.Str("filepath"))
+			if err != nil {
+				return err
+			}
+			anim, err := render.ReadAnimation(path)
+			if err != nil {
+				return err
+			}
+			ctx.Task.SetAnimation(anim)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "txt", Group: "content", Task: true,
+		Usage: "[<scale> [<color> [<bgcolor> [<txt>]]]]",
+		Help:  "send text, or enter interactive text mode if no text is given. \\n breaks lines",
+		Args: []Arg{
+			{Name: "scale", Type: ArgInt, Optional: true, Validate: positive},
+			{Name: "color", Type: ArgColor, Optional: true},
+			{Name: "bgcolor", Type: ArgColor, Optional: true},
+			{Name: "txt", Type: ArgText, Optional: true},
+		},
+		Run: func(ctx *Context) error {
+			s := ctx.session
+			if ctx.Has("scale") {
+				s.text.Scale = float64(ctx.Int("scale"))
+			}
+			if ctx.Has("color") {
+				s.text.Texture = ctx.Color("color")
+			}
+			if ctx.Has("bgcolor") {
+				s.text.Background = ctx.Color("bgcolor")
+			}
+			if !ctx.Has("txt") {
+				fmt.Fprintf(s.out, "[rán] text mode, return via '%v'\n", strings.ToUpper(commandMode))
+				s.mode = textMode
+				ctx.keepTask = true
+				return nil
+			}
+			ctx.Task.Img = render.RenderText(unescapeText(ctx.Str("txt")), s.text)
+			ctx.Task.Anim = nil
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "font", Group: "content",
+		Help: "set font for txt: a builtin font, TTF/OTF or BDF/PCF file, at size in px",
+		Args: []Arg{
+			{Name: "font", Type: ArgString, Optional: true, Complete: render.FontNames},
+			{Name: "size", Type: ArgFloat, Optional: true, Validate: positive},
+		},
+		Run: func(ctx *Context) error {
+			s := ctx.session
+			if !ctx.Has("font") {
+				fmt.Fprintf(s.out, "[rán] font %s, text scale %v. builtin fonts: %s\n",
+					s.fontName, s.text.Scale, strings.Join(render.FontNames(), ", "))
+				return nil
+			}
+			size := 24.0
+			if ctx.Has("size") {
+				size = ctx.Float("size")
+			}
+			path := ctx.Str("font")
+			if !render.IsBuiltinFont(path) {
+				var err error
+				if path, err = r.resolvePath(ctx.session, path); err != nil {
+					return err
 				}
-				if len(args) > 2 {
-					bgCol = parseColorOrPalette(args[2])
+			}
+			face, err := render.LoadFont(path, size)
+			if err != nil {
+				return err
+			}
+			if face.Metrics().Height.Round() <= 0 {
+				return fmt.Errorf("font %s has no height", ctx.Str("font"))
+			}
+			s.text.Face, s.fontName, s.text.Scale = face, fmt.Sprintf("%s %vpx", ctx.Str("font"), size), 1
+			if render.IsBitmapFace(face) {
+				// bitmap fonts have a fixed size, and are upscaled by integer factors to stay crisp
+				s.fontName = ctx.Str("font")
+				if ctx.Has("size") {
+					s.text.Scale = math.Max(1, math.Round(size/float64(face.Metrics().Height.Round())))
+				} else if face == basicfont.Face7x13 {
+					s.text.Scale = 10
 				}
-				if len(args) < 4 {
-					fmt.Printf("[rán] text mode, return via '%v'\n", strings.ToUpper(commandMode))
-					mode = textMode
-					printTask = false
-				} else {
-					input := strings.Join(args[3:], " ")
-					t.Img = render.RenderText(input, textSize, textCol, bgCol)
+				if face == basicfont.Face7x13 {
+					s.text.Face = nil
 				}
-
-			case "img", "i":
-				if len(args) > 0 {
-					path := strings.Join(args, " ")
-					if img, err := render.ReadImage(path); err != nil {
-						fmt.Println(err)
-						continue
-					} else {
-						t.Img = img
+			}
+			fmt.Fprintf(s.out, "[rán] font %s, text scale %v\n", s.fontName, s.text.Scale)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "palettes", Group: "content", Help: "list palettes usable as color, e.g. lgbti or lgbti:vertical",
+		Run: func(ctx *Context) error {
+			tw := tabwriter.NewWriter(ctx.session.out, 0, 8, 2, ' ', 0)
+			for _, name := range render.PaletteNames() {
+				colors := make([]string, len(render.Palettes[name]))
+				for i, c := range render.Palettes[name] {
+					n := color.NRGBAModel.Convert(c).(color.NRGBA)
+					colors[i] = fmt.Sprintf("%02x%02x%02x", n.R, n.G, n.B)
+					if n.A != 0xff {
+						colors[i] += fmt.Sprintf("%02x", n.A)
 					}
 				}
+				fmt.Fprintf(tw, "%s\t%s\n", name, strings.Join(colors, " "))
+			}
+			return tw.Flush()
+		},
+	})
+	showStyle := func(ctx *Context) error {
+		fmt.Fprintf(ctx.session.out, "[rán] %v\n", ctx.session.text)
+		return nil
+	}
+	r.Register(&Command{
+		Name: "txtstyle", Aliases: []string{"ts"}, Group: "content", Help: "show text layout & effects",
+		Run: showStyle,
+		Subs: []*Command{
+			{
+				Name: "wrap", Help: "wrap text at width in px, 0 disables wrapping",
+				Args: []Arg{{Name: "width", Type: ArgInt, Validate: nonNegative}},
+				Run: func(ctx *Context) error {
+					ctx.session.text.MaxWidth = ctx.Int("width")
+					return showStyle(ctx)
+				},
+			},
+			{
+				Name: "align", Help: "align lines of text",
+				Args: []Arg{{Name: "align", Type: ArgString, Choices: []string{"left", "center", "right"}}},
+				Run: func(ctx *Context) (err error) {
+					if ctx.session.text.Align, err = render.NewTextAlign(strings.ToLower(ctx.Str("align"))); err != nil {
+						return err
+					}
+					return showStyle(ctx)
+				},
+			},
+			{
+				Name: "spacing", Help: "set line spacing relative to the font's line height",
+				Args: []Arg{{Name: "factor", Type: ArgFloat, Validate: positive}},
+				Run: func(ctx *Context) error {
+					ctx.session.text.LineSpacing = ctx.Float("factor")
+					return showStyle(ctx)
+				},
+			},
+			{
+				Name: "outline", Help: "outline text, 0 disables the outline",
+				Args: []Arg{
+					{Name: "width", Type: ArgInt, Validate: nonNegative},
+					{Name: "color", Type: ArgColor, Optional: true},
+				},
+				Run: func(ctx *Context) error {
+					ctx.session.text.Outline = ctx.Int("width")
+					if ctx.Has("color") {
+						ctx.session.text.OutlineTex = ctx.Color("color")
+					}
+					return showStyle(ctx)
+				},
+			},
+			{
+				Name: "shadow", Help: "add a drop shadow at the offset, 0 0 disables the shadow",
+				Args: []Arg{
+					{Name: "x", Type: ArgInt},
+					{Name: "y", Type: ArgInt},
+					{Name: "color", Type: ArgColor, Optional: true},
+				},
+				Run: func(ctx *Context) error {
+					ctx.session.text.Shadow = image.Pt(ctx.Int("x"), ctx.Int("y"))
+					if ctx.Has("color") {
+						ctx.session.text.ShadowTex = ctx.Color("color")
+					}
+					return showStyle(ctx)
+				},
+			},
+		},
+	})
+	r.Register(&Command{
+		Name: "scale", Aliases: []string{"s"}, Group: "content", Help: "scale content", Task: true,
+		Args: []Arg{
+			{Name: "facX", Type: ArgFloat, Validate: positive},
+			{Name: "facY", Type: ArgFloat, Optional: true, Validate: positive},
+			{Name: "lofi", Type: ArgString, Optional: true, Choices: []string{"lofi"}},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			facX, facY := ctx.Float("facX"), ctx.Float("facX")
+			if ctx.Has("facY") {
+				facY = ctx.Float("facY")
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.ScaleImage(img, facX, facY, !ctx.Has("lofi"))
+			})
+			return nil
+		},
+		Subs: []*Command{
+			fitCommand(render.Fit, "scale content to fit the canvas or a box, keeping the aspect ratio"),
+			fitCommand(render.Fill, "scale content to cover the canvas or a box, cropping the overflow"),
+			fitCommand(render.Stretch, "scale content to the size of the canvas or a box"),
+		},
+	})
+	interpolations := []string{"nearest", "bilinear", "bicubic"}
+	interpolation := func(ctx *Context) render.Interpolation {
+		if !ctx.Has("interp") {
+			return render.Bilinear
+		}
+		i, _ := render.NewInterpolation(ctx.Str("interp"))
+		return i
+	}
+	r.Register(&Command{
+		Name: "rotate", Aliases: []string{"r"}, Group: "content", Help: "rotate content clockwise, by 90° if no angle is given", Task: true,
+		Args: []Arg{
+			{Name: "deg", Type: ArgFloat, Optional: true},
+			{Name: "interp", Type: ArgString, Optional: true, Choices: interpolations},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			deg := 90.0
+			if ctx.Has("deg") {
+				deg = ctx.Float("deg")
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.RotateImage(img, deg, interpolation(ctx))
+			})
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "flip", Group: "content", Help: "mirror content horizontally or vertically", Task: true,
+		Args: []Arg{{Name: "axis", Type: ArgString, Choices: []string{"h", "v"}}},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			horizontal := ctx.Str("axis") == "h"
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.FlipImage(img, horizontal)
+			})
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "shear", Group: "content", Help: "shear content by px per row along x, and px per column along y", Task: true,
+		Args: []Arg{
+			{Name: "x", Type: ArgFloat},
+			{Name: "y", Type: ArgFloat, Optional: true},
+			{Name: "interp", Type: ArgString, Optional: true, Choices: interpolations},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			sx, sy := ctx.Float("x"), 0.0
+			if ctx.Has("y") {
+				sy = ctx.Float("y")
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.ShearImage(img, sx, sy, interpolation(ctx))
+			})
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "crop", Group: "content", Help: "crop content to the rect at x,y of size w×h", Task: true,
+		Args: []Arg{
+			{Name: "x", Type: ArgInt, Validate: nonNegative},
+			{Name: "y", Type: ArgInt, Validate: nonNegative},
+			{Name: "w", Type: ArgInt, Validate: positive},
+			{Name: "h", Type: ArgInt, Validate: positive},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			rect := image.Rect(0, 0, ctx.Int("w"), ctx.Int("h")).Add(image.Pt(ctx.Int("x"), ctx.Int("y")))
+			// validate on the first frame, so no frame fails halfway
+			if _, err := render.CropImage(ctx.Task.Img, rect); err != nil {
+				return err
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				cropped, err := render.CropImage(img, rect)
+				if err != nil {
+					return img
+				}
+				return cropped
+			})
+			return nil
+		},
+	})
 
-			case "scale", "s":
-				quality := true
-				var facX, facY float64
-				var err error
-				if len(args) >= 1 {
-					facX, err = strconv.ParseFloat(args[0], 64)
+	r.registerAdjustments()
+
+	r.Register(&Command{
+		Name: "order", Aliases: []string{"o"}, Group: "draw modes", Help: "set order (ltr, rtl, ttb, btt, shuffle)", Task: true,
+		Args: []Arg{{Name: "order", Type: ArgString, Choices: []string{"ltr", "rtl", "ttb", "btt", "shuffle", "l", "r", "t", "b", "random"}}},
+		Run: func(ctx *Context) error {
+			ctx.Task.RenderOrder = pixelflut.NewOrder(ctx.Str("order"))
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "offset", Aliases: []string{"of"}, Group: "draw modes", Task: true,
+		Help:  "set top-left offset, or place on the canvas by anchor (e.g. center, bottom-right, 25%,50%)",
+		Usage: "<x> <y> | <anchor>",
+		Args:  []Arg{{Name: "pos", Type: ArgText, Complete: func() []string { return render.AnchorNames }}},
+		Run: func(ctx *Context) error {
+			if p, ok := parsePoint(ctx.Str("pos")); ok {
+				ctx.Task.Offset = p
+				ctx.Task.Anchor = nil
+			} else {
+				a, err := render.ParseAnchor(ctx.Str("pos"))
+				if err != nil {
+					return err
+				}
+				ctx.Task.Offset = image.Point{}
+				ctx.Task.Anchor = &a
+			}
+			ctx.Task.RandOffset = false
+			return nil
+		},
+		Subs: []*Command{{
+			Name: "rand", Help: "random offset for each draw", Task: true,
+			Run: func(ctx *Context) error {
+				ctx.Task.RandOffset = true
+				ctx.Task.Offset = image.Point{}
+				ctx.Task.Anchor = nil
+				return nil
+			},
+		}},
+	})
+	r.Register(&Command{
+		Name: "rgbsplit", Group: "draw modes", Help: "toggle RGB split effect", Task: true,
+		Run: func(ctx *Context) error {
+			if ctx.Task.FX.Contains("rgbsplit") {
+				ctx.Task.FX = removeEffects(ctx.Task.FX, "rgbsplit")
+			} else {
+				ctx.Task.FX = append(render.FX{render.NewRGBSplit(10)}, ctx.Task.FX...)
+			}
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "fx", Group: "draw modes", Help: "show effects, applied in order",
+		Run: func(ctx *Context) error {
+			if len(ctx.Task.FX) == 0 {
+				fmt.Fprintln(ctx.session.out, "no effects")
+			}
+			for i, e := range ctx.Task.FX {
+				fmt.Fprintf(ctx.session.out, "%d\t%s\n", i+1, e)
+			}
+			return nil
+		},
+		Subs: []*Command{
+			{
+				Name: "add", Help: "append an effect", Task: true,
+				Usage: "<effect> [<params>]",
+				Args: []Arg{
+					{Name: "effect", Type: ArgString, Choices: render.EffectNames()},
+					{Name: "params", Type: ArgText, Optional: true},
+				},
+				Run: func(ctx *Context) error {
+					e, err := render.ParseEffect(ctx.Str("effect") + " " + ctx.Str("params"))
 					if err != nil {
-						fmt.Println(err)
-						continue
+						return err
 					}
-					facY = facX
-					if len(args) >= 2 {
-						facY, err = strconv.ParseFloat(args[1], 64)
-						if err != nil {
-							fmt.Println(err)
-							continue
-						}
+					// copy, as the previous task may share the slice
+					ctx.Task.FX = append(append(render.FX{}, ctx.Task.FX...), e)
+					return nil
+				},
+			},
+			{
+				Name: "rm", Help: "remove n-th effect", Task: true,
+				Args: []Arg{{Name: "n", Type: ArgInt, Validate: positive}},
+				Run: func(ctx *Context) error {
+					n := ctx.Int("n") - 1
+					if n >= len(ctx.Task.FX) {
+						return fmt.Errorf("no effect #%d", n+1)
 					}
-					if len(args) > 2 {
-						quality = false
+					fx := append(render.FX{}, ctx.Task.FX[:n]...)
+					ctx.Task.FX = append(fx, ctx.Task.FX[n+1:]...)
+					return nil
+				},
+			},
+			{
+				Name: "move", Help: "move n-th effect to position i", Task: true,
+				Args: []Arg{{Name: "n", Type: ArgInt, Validate: positive}, {Name: "i", Type: ArgInt, Validate: positive}},
+				Run: func(ctx *Context) error {
+					n, i := ctx.Int("n")-1, ctx.Int("i")-1
+					if n >= len(ctx.Task.FX) || i >= len(ctx.Task.FX) {
+						return fmt.Errorf("there are only %d effects", len(ctx.Task.FX))
 					}
-					t.Img = render.ScaleImage(t.Img, facX, facY, quality)
-				}
+					e := ctx.Task.FX[n]
+					fx := append(render.FX{}, ctx.Task.FX[:n]...)
+					fx = append(fx, ctx.Task.FX[n+1:]...)
+					fx = append(fx[:i], append(render.FX{e}, fx[i:]...)...)
+					ctx.Task.FX = fx
+					return nil
+				},
+			},
+			{
+				Name: "clear", Help: "remove all effects", Task: true,
+				Run: func(ctx *Context) error {
+					ctx.Task.FX = nil
+					return nil
+				},
+			},
+		},
+	})
 
-			case "rotate", "r":
-				t.Img = render.RotateImage90(t.Img)
+	r.Register(&Command{
+		Name: "connections", Aliases: []string{"c"}, Group: "networking", Help: "set number of connections per client", Task: true,
+		Args: []Arg{{Name: "n", Type: ArgInt, Validate: positive}},
+		Run: func(ctx *Context) error {
+			ctx.Task.MaxConns = ctx.Int("n")
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "host", Aliases: []string{"address", "a"}, Group: "networking", Help: "set target server", Task: true,
+		Args: []Arg{{Name: "address", Type: ArgString}}, Usage: "<host>:<port>",
+		Run: func(ctx *Context) error {
+			ctx.Task.Address = ctx.Str("address")
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "metrics", Group: "networking", Help: "toggle bandwidth reporting (may cost some performance)",
+		Run: func(ctx *Context) error {
+			ctx.Fluter.ToggleMetrics()
+			return nil
+		},
+	})
 
-			// the commands below don't affect the task, so we don't need to apply it to clients -> continue
+	r.registerHistory()
 
-			case "metrics":
-				f.toggleMetrics()
-				continue
+	r.Register(&Command{
+		Name: "complete", Group: "general", Help: "list completions of a partial command line, one per line",
+		Args: []Arg{{Name: "line", Type: ArgText, Optional: true}},
+		Run: func(ctx *Context) error {
+			for _, c := range r.Complete(ctx.Str("line")) {
+				fmt.Fprintln(ctx.session.out, c)
+			}
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name: "help", Group: "general", Help: "print help, or details of a command",
+		Args: []Arg{{Name: "command", Type: ArgText, Optional: true}},
+		Run: func(ctx *Context) error {
+			if ctx.Has("command") {
+				return r.printCommandHelp(ctx.session.out, ctx.Str("command"))
+			}
+			r.printHelp(ctx.session.out)
+			return nil
+		},
+	})
+}
 
-			case "status":
-				fmt.Println(t)
-				continue
+// registerAdjustments registers commands adjusting the colors of the content
+func (r *REPL) registerAdjustments() {
+	adjust := func(name, help string, arg Arg, fn func(img *image.NRGBA, v float64) *image.NRGBA) {
+		r.Register(&Command{
+			Name: name, Group: "adjust", Help: help, Task: true,
+			Args: []Arg{arg},
+			Run: func(ctx *Context) error {
+				if ctx.Task.Img == nil {
+					return errNoImage
+				}
+				v := ctx.Float(arg.Name)
+				ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA { return fn(img, v) })
+				return nil
+			},
+		})
+	}
+	adjust("brightness", "add to the brightness, from -1 to 1",
+		Arg{Name: "delta", Type: ArgFloat}, render.AdjustBrightness)
+	adjust("contrast", "scale the contrast, 1 keeps it unchanged",
+		Arg{Name: "factor", Type: ArgFloat, Validate: nonNegative}, render.AdjustContrast)
+	adjust("gamma", "apply gamma, >1 brightens midtones",
+		Arg{Name: "gamma", Type: ArgFloat, Validate: positive}, render.AdjustGamma)
+	adjust("saturation", "scale the saturation, 0 is grayscale",
+		Arg{Name: "factor", Type: ArgFloat, Validate: nonNegative}, render.AdjustSaturation)
+	adjust("hue", "rotate the hue by degrees",
+		Arg{Name: "deg", Type: ArgFloat}, render.RotateHue)
 
-			case "help":
-				printHelp()
-				continue
+	r.Register(&Command{
+		Name: "key", Group: "adjust", Task: true,
+		Help: "make a background color transparent, within a tolerance and soft edge of 0 to 1",
+		Args: []Arg{
+			{Name: "color", Type: ArgColor},
+			{Name: "tolerance", Type: ArgFloat, Optional: true, Validate: nonNegative},
+			{Name: "softness", Type: ArgFloat, Optional: true, Validate: nonNegative},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			u, ok := ctx.Color("color").(*image.Uniform)
+			if !ok {
+				return fmt.Errorf("key needs a single color, not a pattern")
+			}
+			key := color.NRGBAModel.Convert(u.C).(color.NRGBA)
+			tolerance, softness := 0.1, 0.05
+			if ctx.Has("tolerance") {
+				tolerance = ctx.Float("tolerance")
+			}
+			if ctx.Has("softness") {
+				softness = ctx.Float("softness")
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.ChromaKey(img, key, tolerance, softness)
+			})
+			return nil
+		},
+		Subs: []*Command{{
+			Name: "luma", Help: "make pixels with a luminance from min to max transparent, 0 is black", Task: true,
+			Args: []Arg{
+				{Name: "min", Type: ArgFloat, Validate: nonNegative},
+				{Name: "max", Type: ArgFloat, Validate: nonNegative},
+			},
+			Run: func(ctx *Context) error {
+				if ctx.Task.Img == nil {
+					return errNoImage
+				}
+				min, max := ctx.Float("min"), ctx.Float("max")
+				ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+					return render.LumaKey(img, min, max)
+				})
+				return nil
+			},
+		}},
+	})
+}
 
-			default:
-				fmt.Print("[rán] unknown command. ")
-				printHelp()
-				continue
+func (r *REPL) registerPlaylist() {
+	p := r.playlist
+	show := func(ctx *Context) error {
+		fmt.Fprintln(ctx.Out, p)
+		return nil
+	}
+	// modify runs fn and shows the resulting playlist
+	modify := func(fn func(ctx *Context) error) func(ctx *Context) error {
+		return func(ctx *Context) error {
+			if err := fn(ctx); err != nil {
+				return err
 			}
+			return show(ctx)
+		}
+	}
 
-			if printTask {
-				fmt.Println(t)
+	r.Register(&Command{
+		Name: "playlist", Aliases: []string{"pl"}, Group: "playlist", Help: "show playlist",
+		Run: show,
+		Subs: []*Command{
+			{
+				Name: "add", Help: "append stored task, played for dur or from hh:mm",
+				Usage: "<name> [<dur>] [@hh:mm]",
+				Args:  []Arg{{Name: "entry", Type: ArgText, Complete: r.storedTasks}},
+				Run: modify(func(ctx *Context) error {
+					e, err := parsePlaylistEntry(strings.Fields(ctx.Str("entry")))
+					if err == nil {
+						p.add(e)
+					}
+					return err
+				}),
+			},
+			{
+				Name: "rm", Help: "remove n-th entry",
+				Args: []Arg{{Name: "n", Type: ArgInt, Validate: positive}},
+				Run: modify(func(ctx *Context) error {
+					return p.remove(ctx.Int("n") - 1)
+				}),
+			},
+			{
+				Name: "clear", Help: "remove all entries",
+				Run: modify(func(ctx *Context) error {
+					p.clear()
+					return nil
+				}),
+			},
+			{
+				Name: "load", Help: "load playlist file",
+				Args: []Arg{{Name: "file", Type: ArgText}},
+				Run: modify(func(ctx *Context) error {
+					path, err := r.resolvePath(ctx.session, ctx.Str("file"))
+					if err != nil {
+						return err
+					}
+					return p.load(path)
+				}),
+			},
+			{
+				Name: "loop", Help: "toggle looping",
+				Run: modify(func(ctx *Context) error {
+					p.toggleLoop()
+					return nil
+				}),
+			},
+			{
+				Name: "shuffle", Help: "toggle shuffling",
+				Run: modify(func(ctx *Context) error {
+					p.toggleShuffle()
+					return nil
+				}),
+			},
+			{
+				Name: "start", Help: "start playback",
+				Run: func(ctx *Context) error {
+					return p.start(r.loadTask)
+				},
+			},
+			{
+				Name: "stop", Help: "stop playback",
+				Run: modify(func(ctx *Context) error {
+					p.halt()
+					return nil
+				}),
+			},
+			{
+				Name: "next", Help: "skip to the next entry",
+				Run: func(ctx *Context) error {
+					p.next()
+					return nil
+				},
+			},
+		},
+	})
+}
+
+func (r *REPL) registerHistory() {
+	// restore applies a task from the history, keeping the paused state
+	restore := func(fn func(current pixelflut.FlutTask, n int) (pixelflut.FlutTask, error)) func(ctx *Context) error {
+		return func(ctx *Context) error {
+			n := 1
+			if ctx.Has("n") {
+				n = ctx.Int("n")
 			}
-			f.applyTask(t)
+			t, err := fn(ctx.Task, n)
+			if err != nil {
+				return err
+			}
+			t.Paused = ctx.Task.Paused
+			fmt.Fprintln(ctx.Out, t)
+			ctx.Fluter.ApplyTask(t)
+			return nil
 		}
 	}
+	steps := []Arg{{Name: "n", Type: ArgInt, Optional: true, Validate: positive}}
+
+	r.Register(&Command{
+		Name: "undo", Aliases: []string{"u"}, Group: "history", Help: "revert the last n task changes",
+		Args: steps, Run: restore(r.history.undo),
+	})
+	r.Register(&Command{
+		Name: "redo", Group: "history", Help: "reapply the last n undone task changes",
+		Args: steps, Run: restore(r.history.redo),
+	})
+	r.Register(&Command{
+		Name: "history", Group: "history", Help: "list task changes",
+		Run: func(ctx *Context) error {
+			fmt.Fprintln(ctx.Out, &r.history)
+			return nil
+		},
+	})
+}
+
+// loadTask applies the stored task with the given name
+func (r *REPL) loadTask(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, err := r.taskStore.Load(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(r.out, t)
+	r.f.ApplyTask(t)
+	return nil
 }
 
-func printHelp() {
-	fmt.Println(`available commands:
-	tasks
-		start                                start fluting
-		stop                                 pause fluting
-		status                               print current task
-		save <name>                          store current task
-		load <name>							 load previously stored task
-	content
-		i <filepath>                         set image
-		txt <scale> <color <bgcolor> <txt>   send text
-		txt [<scale> [<color> [<bgcolor>]]   enter interactive text mode
-		scale <facX> [<facY> [lofi]]         scale content
-		rotate                               rotate content 90°
-	draw modes
-		o                                    set order (l,r,t,b,random)
-		of <x> <y>                           set top-left offset
-		of rand                              random offset for each draw
-		rgbsplit                             toggle RGB split effect
-	networking
-		c <n>                                set number of connections per client
-		a <host>:<port>                      set target server
-		metrics                              toggle bandwidth reporting (may cost some performance)`)
+// update applies a modification of the current task, serialized with
+// commands executed by the REPL. The modification is recorded in the history
+// under the given description.
+func (r *REPL) update(description string, fn func(t *pixelflut.FlutTask)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.f.GetTask()
+	r.history.push(t, description)
+	fn(&t)
+	r.f.ApplyTask(t)
+}
+
+// StartPlaylist loads the playlist file at path, and starts playing it
+func (r *REPL) StartPlaylist(path string) error {
+	if err := r.playlist.load(path); err != nil {
+		return err
+	}
+	return r.playlist.start(r.loadTask)
+}
+
+// SetFileDir sets the directory that remote operators may read files from,
+// e.g. via img or source. If empty, remote operators can't access files.
+func (r *REPL) SetFileDir(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fileDir = dir
+}
+
+// resolvePath returns the path of a file argument given by the session.
+// Paths of sandboxed sessions are resolved within fileDir, and must not leave it.
+func (r *REPL) resolvePath(s *session, path string) (string, error) {
+	return r.resolvePathIn(s, "", path)
+}
+
+// resolvePathIn is resolvePath, but relative paths are resolved against dir
+// instead of the working directory or fileDir, if dir is set.
+func (r *REPL) resolvePathIn(s *session, dir, path string) (string, error) {
+	if !s.sandboxed {
+		if dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return path, nil
+	}
+	if r.fileDir == "" {
+		return "", fmt.Errorf("file access is disabled for remote operators")
+	}
+	root, err := filepath.Abs(r.fileDir)
+	if err != nil {
+		return "", err
+	}
+	base := root
+	if dir != "" && !strings.HasPrefix(path, "/") {
+		base = dir // resolved by a previous call, so within root
+	}
+	resolved := filepath.Join(base, filepath.FromSlash(path))
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = real
+		if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+			root = realRoot
+		}
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of the directory accessible to remote operators", path)
+	}
+	return resolved, nil
+}
+
+// SetTaskStore replaces the store used for the save & load commands
+func (r *REPL) SetTaskStore(s *TaskStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.taskStore = s
+}
+
+// storedTasks returns the names of all stored tasks, sorted alphabetically
+func (r *REPL) storedTasks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.taskStore.List()
+}
+
+// fitCommand creates a subcommand of scale, fitting content into the canvas
+// of the current task's server, or a given box.
+func fitCommand(mode render.FitMode, help string) *Command {
+	return &Command{
+		Name: mode.String(), Help: help, Task: true,
+		Usage: "[<w>x<h>] [lofi]",
+		Args: []Arg{
+			{Name: "box", Type: ArgString, Optional: true},
+			{Name: "lofi", Type: ArgString, Optional: true, Choices: []string{"lofi"}},
+		},
+		Run: func(ctx *Context) error {
+			if ctx.Task.Img == nil {
+				return errNoImage
+			}
+			box, lofi := ctx.Str("box"), ctx.Has("lofi")
+			if box == "lofi" {
+				box, lofi = "", true
+			}
+			var size image.Point
+			if box != "" {
+				var ok bool
+				if size, ok = parsePoint(strings.Replace(box, "x", " ", 1)); !ok || size.X <= 0 || size.Y <= 0 {
+					return fmt.Errorf("invalid box '%s', expected e.g. 640x480", box)
+				}
+			} else {
+				var err error
+				if size, err = pixelflut.CanvasSize(ctx.Task.Address); err != nil {
+					return fmt.Errorf("can't determine canvas size: %w", err)
+				}
+			}
+			ctx.Task.MapFrames(func(img *image.NRGBA) *image.NRGBA {
+				return render.FitImage(img, size, mode, !lofi)
+			})
+			return nil
+		},
+	}
+}
+
+// unescapeText replaces `\n` with line breaks, as REPL input is a single line
+func unescapeText(s string) string {
+	return strings.ReplaceAll(s, `\n`, "\n")
+}
+
+// removeEffects returns a copy of fx without effects of the given name
+func removeEffects(fx render.FX, name string) (out render.FX) {
+	for _, e := range fx {
+		if e.Name() != name {
+			out = append(out, e)
+		}
+	}
+	return out
 }
 
 // try to parse as hex-encoded RGB color,
-// alternatively treat it as palette name. If both fail,
-// give image.Transparent
-func parseColorOrPalette(input string) image.Image {
+// alternatively treat it as palette or pattern name.
+// Palettes are drawn as stripes, configured by `<name>[:<orientation>[:<widths>]]`,
+// where widths is the total size, or a comma separated width per stripe.
+func parseColorOrPalette(input string) (image.Image, error) {
 	if input == "w" {
-		return image.NewUniform(color.White)
+		return image.NewUniform(color.White), nil
 	} else if input == "b" {
-		return image.NewUniform(color.Black)
+		return image.NewUniform(color.Black), nil
 	} else if input == "t" {
-		return image.Transparent
-	} else if col, err := hex.DecodeString(input); err == nil && len(col) >= 3 {
+		return image.Transparent, nil
+	} else if col, err := hex.DecodeString(input); err == nil {
+		if len(col) != 3 && len(col) != 4 {
+			return nil, fmt.Errorf("invalid hex color '%s', expected RGB or RGBA such as ff0000", input)
+		}
 		var alpha byte = 0xff
 		if len(col) == 4 {
 			alpha = col[3]
 		}
-		return image.NewUniform(color.NRGBA{col[0], col[1], col[2], alpha})
+		return image.NewUniform(color.NRGBA{col[0], col[1], col[2], alpha}), nil
 	}
 
-	if pal := render.PrideFlags[input]; len(pal) != 0 {
-		return &render.StripePattern{Palette: pal, Size: 13}
+	name, opts := input, ""
+	if i := strings.Index(input, ":"); i >= 0 {
+		name, opts = input[:i], input[i+1:]
+	}
+	if pal := render.Palettes[name]; len(pal) != 0 {
+		return parseStripes(pal, opts)
 	}
 
 	if p, ok := render.DynPatterns[input]; ok {
-		return p
+		return p, nil
 	}
 
-	return image.Transparent
+	return nil, fmt.Errorf("unknown color '%s', expected hex color such as ff0000, or a palette or pattern name", input)
+}
+
+// parseStripes creates a StripePattern with the options `<orientation>[:<widths>]`
+func parseStripes(pal color.Palette, opts string) (*render.StripePattern, error) {
+	p := &render.StripePattern{Palette: pal, Size: 13}
+	parts := strings.SplitN(opts, ":", 2)
+	if parts[0] != "" {
+		o, err := render.NewStripeOrientation(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		p.Orientation = o
+	}
+	if len(parts) < 2 {
+		return p, nil
+	}
+	var widths []int
+	for _, w := range strings.Split(parts[1], ",") {
+		n, err := strconv.Atoi(w)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid stripe width '%s', expected positive integers separated by ','", w)
+		}
+		widths = append(widths, n)
+	}
+	if len(widths) == 1 {
+		p.Size = widths[0]
+	} else {
+		p.Widths = widths
+	}
+	return p, nil
+}
+
+// parsePoint parses exactly two integers separated by whitespace, such as `12 -3`
+func parsePoint(input string) (p image.Point, ok bool) {
+	fields := strings.Fields(input)
+	if len(fields) != 2 {
+		return p, false
+	}
+	x, errX := strconv.Atoi(fields[0])
+	y, errY := strconv.Atoi(fields[1])
+	return image.Pt(x, y), errX == nil && errY == nil
 }
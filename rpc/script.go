@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxScriptDepth limits nesting of `source` commands, to catch scripts sourcing themselves
+const maxScriptDepth = 8
+
+var errScriptAborted = errors.New("script aborted")
+
+// Source runs the REPL commands in the file at path, see RunScript.
+func (r *REPL) Source(path string) error {
+	return r.sourceFrom(nil, path)
+}
+
+// sourceFrom runs the script at path on behalf of the caller session, with the
+// same access to files
+func (r *REPL) sourceFrom(caller *session, path string) error {
+	s := r.scriptSession()
+	defer r.endScript()
+	if caller != nil {
+		s.sandboxed = caller.sandboxed
+	}
+	return r.source(s, path, 0)
+}
+
+func (r *REPL) source(s *session, path string, depth int) error {
+	if depth >= maxScriptDepth {
+		return fmt.Errorf("%s: scripts nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func(dir string) { s.dir = dir }(s.dir)
+	s.dir = filepath.Dir(path)
+	fmt.Fprintf(r.out, "[rán] running script %s\n", path)
+	if err := r.runScript(s, f, path, depth); err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "[rán] script %s done\n", path)
+	return nil
+}
+
+// RunScript executes REPL commands from the reader line by line. In addition to
+// the regular commands, scripts support the following primitives:
+//
+//	# comment            lines starting with # are ignored
+//	sleep <duration>     pause the script, e.g. `sleep 1m30s`
+//	wait                 pause the script, until an operator enters `continue`
+//	source <file>        run another script, then continue with this one.
+//	                     Relative paths are resolved against the directory of this script
+//
+// Each script runs in its own session, so e.g. entering text mode doesn't
+// affect the operators. Operators stop all running scripts with `abort`.
+func (r *REPL) RunScript(in io.Reader, name string) error {
+	s := r.scriptSession()
+	defer r.endScript()
+	return r.runScript(s, in, name, 0)
+}
+
+// scriptSession registers a running script, and returns its session.
+// endScript must be called once the script is done.
+func (r *REPL) scriptSession() *session {
+	s := newSession("", os.Stdout)
+	r.scriptMu.Lock()
+	defer r.scriptMu.Unlock()
+	r.scripts++
+	s.abort = r.abort
+	return s
+}
+
+func (r *REPL) endScript() {
+	r.scriptMu.Lock()
+	defer r.scriptMu.Unlock()
+	r.scripts--
+}
+
+// abortScripts stops all running scripts before their next command, and
+// interrupts their sleep or wait. Returns the number of aborted scripts.
+func (r *REPL) abortScripts() int {
+	r.scriptMu.Lock()
+	defer r.scriptMu.Unlock()
+	if r.scripts > 0 {
+		close(r.abort)
+		r.abort = make(chan struct{})
+	}
+	return r.scripts
+}
+
+func (r *REPL) runScript(s *session, in io.Reader, name string, depth int) error {
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		select {
+		case <-s.abort:
+			return fmt.Errorf("%s:%d: %w", name, n, errScriptAborted)
+		default:
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch strings.ToLower(fields[0]) {
+		case "sleep":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: usage: sleep <duration>", name, n)
+			}
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			select {
+			case <-time.After(d):
+			case <-s.abort:
+				return fmt.Errorf("%s:%d: %w", name, n, errScriptAborted)
+			}
+
+		case "wait":
+			fmt.Fprintf(r.out, "[rán] script %s is waiting, enter 'continue' to resume\n", name)
+			select {
+			case <-r.resume:
+			case <-s.abort:
+				return fmt.Errorf("%s:%d: %w", name, n, errScriptAborted)
+			}
+
+		case "source":
+			path, err := r.resolvePathIn(s, s.dir, strings.Join(fields[1:], " "))
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			if err := r.source(s, path, depth+1); err != nil {
+				return fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+
+		default:
+			r.exec(s, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// resumeScript continues a script blocked in `wait`
+func (r *REPL) resumeScript() {
+	select {
+	case r.resume <- struct{}{}:
+	default:
+		fmt.Fprintln(r.out, "no script is waiting")
+	}
+}
@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceSandbox(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "hochwasser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string]string{
+		"outside.txt":     "# not accessible to remote operators\n",
+		"root/sub/a.txt":  "source b.txt\n",
+		"root/sub/b.txt":  "source ../../outside.txt\n",
+		"root/escape.txt": "source /sub/../../outside.txt\n",
+		"root/nested.txt": "source sub/a.txt\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, _ := newTestRán(t)
+	repl := r.repl
+	repl.out = newBroadcaster(ioutil.Discard)
+	repl.SetFileDir(filepath.Join(tmp, "root"))
+
+	// the console may source any file, relative to the sourcing script
+	if err := repl.sourceFrom(repl.console, filepath.Join(tmp, "root/nested.txt")); err != nil {
+		t.Errorf("local script failed: %v", err)
+	}
+
+	// scripts of remote operators stay within the file directory
+	operator := newSession("operator", ioutil.Discard)
+	for _, script := range []string{"nested.txt", "escape.txt"} {
+		path, err := repl.resolvePath(operator, script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repl.sourceFrom(operator, path)
+		if err == nil || !strings.Contains(err.Error(), "outside of the directory") {
+			t.Errorf("%s: remote script left the file directory: %v", script, err)
+		}
+	}
+}
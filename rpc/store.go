@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+// TaskStore keeps named FlutTasks. If it is backed by a directory, each task
+// is persisted as `<name>.json` containing the FlutTaskOpts, and `<name>.png`
+// containing the image, so tasks survive restarts and can be shared as files.
+// Frames of animated tasks are stored in `<name>.frames/`, see render.WriteFrameDir.
+type TaskStore struct {
+	mu    sync.Mutex
+	dir   string
+	tasks map[string]pixelflut.FlutTask
+}
+
+// NewTaskStore creates a TaskStore that is held in memory only.
+func NewTaskStore() *TaskStore {
+	return &TaskStore{tasks: make(map[string]pixelflut.FlutTask)}
+}
+
+// OpenTaskStore creates a TaskStore persisted in dir, preloading all tasks
+// found there. The directory is created if it doesn't exist.
+func OpenTaskStore(dir string) (*TaskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := NewTaskStore()
+	s.dir = dir
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".json")
+		t, err := s.readTask(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not load task '%s': %w", name, err)
+		}
+		s.tasks[name] = t
+	}
+	fmt.Printf("[rán] loaded %d tasks from %s\n", len(s.tasks), dir)
+	return s, nil
+}
+
+// Save stores the task under name, overwriting any previous task with that name.
+func (s *TaskStore) Save(name string, t pixelflut.FlutTask) error {
+	if err := validateTaskName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		if err := s.writeTask(name, t); err != nil {
+			return err
+		}
+	}
+	s.tasks[name] = t
+	return nil
+}
+
+// Load returns the task stored under name. Tasks that were added to the
+// directory after opening the store are read from disk.
+func (s *TaskStore) Load(name string) (pixelflut.FlutTask, error) {
+	if err := validateTaskName(name); err != nil {
+		return pixelflut.FlutTask{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[name]; ok {
+		return t, nil
+	}
+	if s.dir == "" {
+		return pixelflut.FlutTask{}, fmt.Errorf("no task named '%s'", name)
+	}
+	t, err := s.readTask(name)
+	if os.IsNotExist(err) {
+		return t, fmt.Errorf("no task named '%s'", name)
+	} else if err != nil {
+		return t, err
+	}
+	s.tasks[name] = t
+	return t, nil
+}
+
+// Delete removes the task stored under name, including its files.
+func (s *TaskStore) Delete(name string) error {
+	if err := validateTaskName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.tasks[name]
+	delete(s.tasks, name)
+	if s.dir != "" {
+		for _, ext := range []string{".json", ".png"} {
+			err := os.Remove(filepath.Join(s.dir, name+ext))
+			if err == nil {
+				found = true
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, name+".frames")); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no task named '%s'", name)
+	}
+	return nil
+}
+
+// List returns the names of all stored tasks, sorted alphabetically.
+func (s *TaskStore) List() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.tasks))
+	for name := range s.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *TaskStore) readTask(name string) (t pixelflut.FlutTask, err error) {
+	base := filepath.Join(s.dir, name)
+	opts, err := ioutil.ReadFile(base + ".json")
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(opts, &t.FlutTaskOpts); err != nil {
+		return
+	}
+	// tasks stored before effects were introduced only had an RGB split toggle
+	var legacy struct{ RGBSplit bool }
+	if json.Unmarshal(opts, &legacy) == nil && legacy.RGBSplit && len(t.FX) == 0 {
+		t.FX = render.FX{render.NewRGBSplit(10)}
+	}
+	// tasks without image are valid, they just aren't flutable
+	if _, err = os.Stat(base + ".png"); os.IsNotExist(err) {
+		return t, nil
+	}
+	if t.Img, err = render.ReadImage(base + ".png"); err != nil {
+		return
+	}
+	if _, err = os.Stat(base + ".frames"); os.IsNotExist(err) {
+		return t, nil
+	}
+	anim, err := render.ReadFrameDir(base + ".frames")
+	if err != nil {
+		return
+	}
+	t.SetAnimation(anim)
+	return
+}
+
+func (s *TaskStore) writeTask(name string, t pixelflut.FlutTask) error {
+	base := filepath.Join(s.dir, name)
+	opts, err := json.MarshalIndent(t.FlutTaskOpts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to temporary files first, so a crash can't leave broken tasks behind
+	if err = ioutil.WriteFile(base+".json.tmp", opts, 0644); err != nil {
+		return err
+	}
+	if t.Img != nil {
+		if err = render.WriteImage(base+".png.tmp", t.Img); err != nil {
+			return err
+		}
+		if err = os.Rename(base+".png.tmp", base+".png"); err != nil {
+			return err
+		}
+	} else if err = os.Remove(base + ".png"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.RemoveAll(base + ".frames.tmp"); err != nil {
+		return err
+	}
+	if t.IsAnimated() {
+		if err = render.WriteFrameDir(base+".frames.tmp", t.Anim); err != nil {
+			return err
+		}
+	}
+	if err = os.RemoveAll(base + ".frames"); err != nil {
+		return err
+	}
+	if t.IsAnimated() {
+		if err = os.Rename(base+".frames.tmp", base+".frames"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(base+".json.tmp", base+".json")
+}
+
+func validateTaskName(name string) error {
+	if name == "" {
+		return fmt.Errorf("must specify name")
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid task name '%s'", name)
+	}
+	return nil
+}
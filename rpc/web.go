@@ -0,0 +1,551 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SpeckiJ/Hochwasser/pixelflut"
+	"github.com/SpeckiJ/Hochwasser/render"
+)
+
+const (
+	maxUploadSize  = 32 << 20 // bytes of an uploaded image file
+	maxWebSessions = 64       // least recently used sessions are dropped beyond this
+	sessionCookie  = "hochwasser-session"
+)
+
+// dashboard serves a web UI to monitor & steer a Rán
+type dashboard struct {
+	r     *Rán
+	token string // required for all requests but the index, if not empty
+
+	// REPL sessions of the browsers, so each has its own text mode & font
+	sessionsMu sync.Mutex
+	sessions   map[string]*webSession
+
+	// live view of the canvas of the current task's target server
+	canvasMu   sync.Mutex
+	canvas     *image.NRGBA
+	canvasAddr string
+	canvasStop chan bool
+	canvasErrs <-chan error
+}
+
+type webSession struct {
+	mu       sync.Mutex // serializes the commands of a browser, as their output is captured per request
+	s        *session
+	lastUsed time.Time
+}
+
+type dashboardClient struct {
+	Addr        string
+	Fluting     bool
+	Conns       int
+	BytesPerSec int
+	BytesTotal  int
+}
+
+type dashboardStatus struct {
+	Task        pixelflut.FlutTaskOpts
+	TaskSummary string
+	Order       string
+	ImgSize     string
+	Metrics     pixelflut.Performance
+	Clients     []dashboardClient
+	StoredTasks []string
+	Events      []string
+}
+
+// ServeDashboard starts a web UI on the given address, that shows the current
+// task, the live canvas & client metrics, and allows basic control of the flut.
+// If token is not empty, it has to be sent with each request, either in the
+// X-Hochwasser-Token header, or as cookie which is set by opening `/?token=<token>`.
+// Without token, the dashboard is only served on loopback addresses.
+func (r *Rán) ServeDashboard(address, token string) {
+	d := &dashboard{r: r, token: token, sessions: make(map[string]*webSession)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.handleIndex)
+	mux.HandleFunc("/api/status", d.auth(d.handleStatus))
+	mux.HandleFunc("/api/cmd", d.auth(d.handleCmd))
+	mux.HandleFunc("/api/complete", d.auth(d.handleComplete))
+	mux.HandleFunc("/api/upload", d.auth(d.handleUpload))
+	mux.HandleFunc("/preview.png", d.auth(d.handlePreview))
+	mux.HandleFunc("/canvas.png", d.auth(d.handleCanvas))
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && token == "" && !addr.IP.IsLoopback() {
+		log.Fatalf("[rán] refusing to serve the web dashboard on %s without token, listen on a loopback address or set a token", l.Addr())
+	}
+	fmt.Printf("[rán] web dashboard listening on http://%s\n", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("[rán] web dashboard stopped: %s", err)
+		}
+	}()
+}
+
+const tokenCookie = "hochwasser-token"
+
+// auth rejects requests without a valid token, and state changing requests
+// from other origins
+func (d *dashboard) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if d.token != "" {
+			token := req.Header.Get("X-Hochwasser-Token")
+			if c, err := req.Cookie(tokenCookie); err == nil && token == "" {
+				token = c.Value
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if req.Method != http.MethodGet && !sameOrigin(req) {
+			http.Error(w, "cross origin request", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// sameOrigin reports whether req was sent by a page served from this host.
+// Requests without Origin header don't come from a browser.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+func (d *dashboard) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	if token := req.URL.Query().Get("token"); token != "" {
+		http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+func (d *dashboard) handleStatus(w http.ResponseWriter, req *http.Request) {
+	t := d.r.GetTask()
+	s := dashboardStatus{
+		Task:        t.FlutTaskOpts,
+		TaskSummary: t.String(),
+		Order:       t.RenderOrder.String(),
+		Metrics:     d.r.getMetrics(),
+		StoredTasks: d.r.repl.storedTasks(),
+		Clients:     []dashboardClient{},
+		Events:      d.r.getEvents(),
+	}
+	if t.Img != nil {
+		s.ImgSize = t.Img.Bounds().Size().String()
+	}
+	for _, c := range d.r.clients.list() {
+		status, _ := c.getStatus()
+		client := dashboardClient{Addr: c.addr, Fluting: status.Fluting}
+		if p := status.Performance; p != nil {
+			client.Conns = p.Conns
+			client.BytesPerSec = p.BytesPerSec
+			client.BytesTotal = p.BytesTotal
+		}
+		s.Clients = append(s.Clients, client)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCmd executes a REPL command, so the UI gets the same semantics as the terminal
+func (d *dashboard) handleCmd(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cmd := req.FormValue("cmd")
+	if cmd == "" {
+		http.Error(w, "missing cmd", http.StatusBadRequest)
+		return
+	}
+	ws := d.browserSession(w, req)
+	ws.mu.Lock()
+	out := bytes.Buffer{}
+	ws.s.out = &out
+	err := d.r.repl.exec(ws.s, cmd)
+	ws.s.out = ioutil.Discard
+	ws.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(out.Bytes())
+}
+
+// browserSession returns the REPL session of the browser sending req,
+// identified by a cookie. New browsers get a new session.
+func (d *dashboard) browserSession(w http.ResponseWriter, req *http.Request) *webSession {
+	d.sessionsMu.Lock()
+	defer d.sessionsMu.Unlock()
+	var id string
+	if c, err := req.Cookie(sessionCookie); err == nil {
+		id = c.Value
+	}
+	ws, ok := d.sessions[id]
+	if !ok {
+		if len(d.sessions) >= maxWebSessions {
+			d.dropOldestSession()
+		}
+		id = randomHex(16)
+		ws = &webSession{s: newSession("web-"+id[:6], ioutil.Discard)}
+		ws.s.tee = true // browsers don't receive the broadcast output
+		d.sessions[id] = ws
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	}
+	ws.lastUsed = time.Now()
+	return ws
+}
+
+// dropOldestSession forgets the least recently used session. d.sessionsMu must be held.
+func (d *dashboard) dropOldestSession() {
+	var oldest string
+	for id, ws := range d.sessions {
+		if oldest == "" || ws.lastUsed.Before(d.sessions[oldest].lastUsed) {
+			oldest = id
+		}
+	}
+	delete(d.sessions, oldest)
+}
+
+// handleComplete suggests completions of a partial REPL command
+func (d *dashboard) handleComplete(w http.ResponseWriter, req *http.Request) {
+	completions := d.r.repl.Complete(req.FormValue("line"))
+	if completions == nil {
+		completions = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(completions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (d *dashboard) handleUpload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	file, _, err := req.FormFile("image")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid upload, at most %d MiB are accepted: %s", maxUploadSize>>20, err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	anim, err := render.DecodeAnimation(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := fmt.Sprintf("web upload: image %v, %d frames", anim.Frames[0].Bounds().Size(), len(anim.Frames))
+	fmt.Printf("[rán] %s\n", msg)
+	d.r.repl.update("web upload", func(t *pixelflut.FlutTask) { t.SetAnimation(anim) })
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, msg)
+}
+
+func (d *dashboard) handlePreview(w http.ResponseWriter, req *http.Request) {
+	img := d.r.GetTask().Img
+	if img == nil {
+		http.Error(w, "no image", http.StatusNotFound)
+		return
+	}
+	writePNG(w, img)
+}
+
+func (d *dashboard) handleCanvas(w http.ResponseWriter, req *http.Request) {
+	img, err := d.liveCanvas(d.r.GetTask().Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writePNG(w, img)
+}
+
+// liveCanvas returns the canvas of the server at address, which is fetched
+// continuously. Fetching is (re)started on first request for an address.
+func (d *dashboard) liveCanvas(address string) (*image.NRGBA, error) {
+	d.canvasMu.Lock()
+	defer d.canvasMu.Unlock()
+
+	if address == "" {
+		return nil, fmt.Errorf("no target server set")
+	}
+	if address == d.canvasAddr && d.canvas != nil {
+		select {
+		case err := <-d.canvasErrs:
+			// the connection was lost, e.g. due to a server restart, so refetch
+			log.Printf("[rán] fetching canvas of %s failed: %s", address, err)
+		default:
+			return d.canvas, nil
+		}
+	}
+
+	if d.canvasStop != nil {
+		close(d.canvasStop)
+	}
+	d.canvas, d.canvasAddr = nil, ""
+	d.canvasStop = make(chan bool)
+	img, errs, err := pixelflut.FetchImage(nil, address, 1, d.canvasStop)
+	if err != nil {
+		return nil, err
+	}
+	d.canvas, d.canvasErrs, d.canvasAddr = img, errs, address
+	return d.canvas, nil
+}
+
+func writePNG(w http.ResponseWriter, img image.Image) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := png.Encode(w, img); err != nil {
+		log.Printf("[rán] unable to send image: %s", err)
+	}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Hochwasser · Rán</title>
+<style>
+	body { font-family: monospace; background: #112; color: #dde; margin: 1em; }
+	h1, h2 { color: #6af; font-weight: normal; }
+	section { display: inline-block; vertical-align: top; margin: 0 2em 2em 0; }
+	img { max-width: 40vw; max-height: 40vh; background: repeating-conic-gradient(#333 0 25%, #222 0 50%) 0 0 / 16px 16px; image-rendering: pixelated; }
+	pre { background: #223; padding: 0.5em; }
+	button, input, select { font-family: monospace; background: #223; color: #dde; border: 1px solid #446; padding: 0.3em; }
+	table { border-collapse: collapse; }
+	td, th { padding: 0.2em 0.8em; text-align: left; }
+	canvas { background: #223; }
+	#output:empty { display: none; }
+	#output.error { color: #f66; }
+</style>
+</head>
+<body>
+<h1>🌊 Hochwasser · Rán</h1>
+
+<section>
+	<h2>task</h2>
+	<pre id="task"></pre>
+	<p>
+		<button onclick="cmd('start')">start</button>
+		<button onclick="cmd('stop')">stop</button>
+		<button onclick="cmd('metrics')">toggle metrics</button>
+	</p>
+	<p>
+		<select id="order">
+			<option value="ltr">→ ltr</option>
+			<option value="rtl">← rtl</option>
+			<option value="ttb">↓ ttb</option>
+			<option value="btt">↑ btt</option>
+			<option value="shuffle">random</option>
+		</select>
+		<button onclick="cmd('o ' + val('order'))">set order</button>
+	</p>
+	<p>
+		<input id="ofx" size="5" placeholder="x"> <input id="ofy" size="5" placeholder="y">
+		<button onclick="cmd('of ' + val('ofx') + ' ' + val('ofy'))">set offset</button>
+		<button onclick="cmd('of rand')">random offset</button>
+	</p>
+	<form id="upload">
+		<input type="file" name="image" accept="image/*"> <button>upload image</button>
+	</form>
+	<form id="repl">
+		<input id="line" size="40" list="completions" autocomplete="off" placeholder="command, e.g. help">
+		<datalist id="completions"></datalist>
+		<button>run</button>
+	</form>
+	<pre id="output"></pre>
+</section>
+
+<section>
+	<h2>events</h2>
+	<pre id="events"></pre>
+</section>
+
+<section>
+	<h2>stored tasks</h2>
+	<ul id="stored"></ul>
+</section>
+
+<section>
+	<h2>clients</h2>
+	<p id="total"></p>
+	<table>
+		<thead><tr><th>address</th><th>fluting</th><th>conns</th><th>total</th><th>throughput</th><th></th></tr></thead>
+		<tbody id="clients"></tbody>
+	</table>
+</section>
+
+<br>
+<section><h2>preview</h2><img id="preview" alt="no task image"></section>
+<section><h2>canvas</h2><img id="canvas" alt="canvas unavailable"></section>
+
+<script>
+const throughput = {};
+const historyLength = 60;
+
+function val(id) { return document.getElementById(id).value; }
+
+// show displays the response of a command or upload, highlighting errors
+function show(res) {
+	return res.text().then(text => {
+		const out = document.getElementById('output');
+		out.textContent = text.trim();
+		out.className = res.ok ? '' : 'error';
+	});
+}
+
+function cmd(c) {
+	const body = new URLSearchParams({ cmd: c });
+	return fetch('api/cmd', { method: 'POST', body }).then(show).then(refresh);
+}
+
+function fmtBit(b) {
+	b *= 8;
+	const units = ['b', 'kb', 'Mb', 'Gb', 'Tb'];
+	let i = 0;
+	for (; b >= 1000 && i < units.length - 1; i++) b /= 1000;
+	return b.toFixed(1) + ' ' + units[i] + '/s';
+}
+
+function fmtBytes(b) {
+	const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+	let i = 0;
+	for (; b >= 1024 && i < units.length - 1; i++) b /= 1024;
+	return b.toFixed(1) + ' ' + units[i];
+}
+
+function sparkline(values) {
+	const c = document.createElement('canvas');
+	c.width = 2 * historyLength;
+	c.height = 24;
+	const ctx = c.getContext('2d');
+	const max = Math.max(1, ...values);
+	ctx.strokeStyle = '#6af';
+	ctx.beginPath();
+	values.forEach((v, i) => ctx.lineTo(2 * i, c.height - v / max * c.height));
+	ctx.stroke();
+	return c;
+}
+
+function renderClients(clients) {
+	const tbody = document.getElementById('clients');
+	tbody.innerHTML = '';
+	for (const c of clients) {
+		const h = throughput[c.Addr] = (throughput[c.Addr] || []).concat(c.BytesPerSec).slice(-historyLength);
+		const tr = document.createElement('tr');
+		for (const v of [c.Addr, c.Fluting ? 'yes' : 'no', c.Conns, fmtBytes(c.BytesTotal), fmtBit(c.BytesPerSec)]) {
+			const td = document.createElement('td');
+			td.textContent = v;
+			tr.appendChild(td);
+		}
+		const td = document.createElement('td');
+		td.appendChild(sparkline(h));
+		tr.appendChild(td);
+		tbody.appendChild(tr);
+	}
+}
+
+function renderStored(names) {
+	const ul = document.getElementById('stored');
+	ul.innerHTML = '';
+	for (const name of names) {
+		const li = document.createElement('li');
+		const b = document.createElement('button');
+		b.textContent = 'load ' + name;
+		b.onclick = () => cmd('load ' + name);
+		li.appendChild(b);
+		ul.appendChild(li);
+	}
+}
+
+function refresh() {
+	return fetch('api/status').then(r => {
+		if (r.status == 401) throw new Error('unauthorized, open this page as /?token=<token>');
+		return r.json();
+	}).then(s => {
+		document.getElementById('task').textContent = s.TaskSummary;
+		document.getElementById('total').textContent = s.Metrics.Enabled
+			? s.Clients.length + ' clients, ' + s.Metrics.Conns + ' conns, ' + fmtBit(s.Metrics.BytesPerSec)
+			: s.Clients.length + ' clients (metrics disabled)';
+		renderClients(s.Clients);
+		renderStored(s.StoredTasks);
+		document.getElementById('events').textContent = s.Events.slice(-10).reverse().join('\n');
+	}).catch(err => {
+		document.getElementById('task').textContent = err.message;
+	});
+}
+
+function refreshImages() {
+	const t = Date.now();
+	document.getElementById('preview').src = 'preview.png?' + t;
+	document.getElementById('canvas').src = 'canvas.png?' + t;
+}
+
+document.getElementById('upload').onsubmit = e => {
+	e.preventDefault();
+	fetch('api/upload', { method: 'POST', body: new FormData(e.target) })
+		.then(show).then(refresh).then(refreshImages);
+};
+
+document.getElementById('repl').onsubmit = e => {
+	e.preventDefault();
+	const line = document.getElementById('line');
+	cmd(line.value).then(refreshImages);
+	line.value = '';
+};
+
+document.getElementById('line').oninput = e => {
+	fetch('api/complete?' + new URLSearchParams({ line: e.target.value }))
+		.then(res => res.json())
+		.then(completions => {
+			const list = document.getElementById('completions');
+			list.replaceChildren(...completions.map(c => {
+				const o = document.createElement('option');
+				o.value = c;
+				return o;
+			}));
+		});
+};
+
+refresh();
+refreshImages();
+setInterval(refresh, 1000);
+setInterval(refreshImages, 3000);
+</script>
+</body>
+</html>
+`
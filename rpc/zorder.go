@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"image"
+	"sort"
+)
+
+// zKey returns the position of (x, y) on the Z-order curve, by interleaving the bits of x & y.
+func zKey(x, y uint32) uint64 {
+	return spreadBits(x) | spreadBits(y)<<1
+}
+
+// spreadBits inserts a zero bit before each bit of v
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// zOrderPart splits the visible pixels of img into n parts of equal pixel count
+// along the Z-order curve, and returns part i as an image with the same bounds,
+// where all other pixels are transparent. As the curve preserves locality, each
+// part is a spatially coherent region. The split is deterministic, so peers
+// with the same view of the swarm compute disjoint parts.
+func zOrderPart(img *image.NRGBA, i, n int) (part *image.NRGBA, numPixels int) {
+	b := img.Bounds()
+	keys := make([]uint64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.NRGBAAt(x, y).A != 0 {
+				keys = append(keys, zKey(uint32(x-b.Min.X), uint32(y-b.Min.Y)))
+			}
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+
+	part = image.NewNRGBA(b)
+	if len(keys) == 0 {
+		return part, 0
+	}
+	lo, hi := keys[len(keys)*i/n], keys[len(keys)-1]
+	last := i == n-1
+	if !last {
+		hi = keys[len(keys)*(i+1)/n]
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			k := zKey(uint32(x-b.Min.X), uint32(y-b.Min.Y))
+			if k >= lo && (k < hi || last && k == hi) {
+				part.SetNRGBA(x, y, c)
+				numPixels++
+			}
+		}
+	}
+	return part, numPixels
+}